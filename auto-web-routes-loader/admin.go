@@ -0,0 +1,230 @@
+package main
+
+// This file contains the admin API which manages the routes over HTTP. Every
+// change is validated like a reload, applied live and persisted into the routes
+// file through a temporary file renamed over it, so the file watcher never sees
+// a partial file. Changes must carry the ETag of the routes they were based on,
+// the checksum of the routes file content, in the If-Match header so that
+// concurrent changes are not lost, even across restarts.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxRouteBody is the maximum size in bytes of a route sent to the admin API.
+const maxRouteBody = 64 << 10
+
+var (
+	errVersionConflict = errors.New("the routes changed since the given ETag")
+	errRouteNotFound   = errors.New("route not found")
+	errRouteExists     = errors.New("route already exists")
+	errPersist         = errors.New("failed to persist the routes")
+)
+
+// changeRoutes applies change to a copy of the routes with the given checksum,
+// then validates, persists and publishes the result.
+func changeRoutes(checksum string, change func(routes map[string]*route) error) (*routesTable, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	current := currentRoutes.Load()
+	if current == nil || current.checksum != checksum {
+		return nil, errVersionConflict
+	}
+	routes := make(map[string]*route, len(current.routes)+1)
+	for path, rt := range current.routes {
+		routes[path] = rt
+	}
+	if err := change(routes); err != nil {
+		return nil, err
+	}
+	m, err := newMatcher(routes)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file is kept readable - urls are not escaped as html.
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(routesFile{Version: routesSchemaVersion, Routes: routes}); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(routesFilePath, content.Bytes()); err != nil {
+		return nil, fmt.Errorf("%w: %v", errPersist, err)
+	}
+	// the watcher then finds the content it would load already in use.
+	sum := sha256.Sum256(content.Bytes())
+	latestSum = sum
+	return publishRoutes(routes, m, sum), nil
+}
+
+// writeFileAtomic replaces the content of the file at path by writing a
+// temporary file in the same directory and renaming it over the file. A
+// symbolic link is followed so the link itself is kept.
+func writeFileAtomic(path string, content []byte) error {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeAdminJSON writes v as the JSON response with the given status code.
+func writeAdminJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAdminError writes an error message as the JSON response.
+func writeAdminError(w http.ResponseWriter, code int, msg string) {
+	writeAdminJSON(w, code, map[string]string{"error": msg})
+}
+
+// routesResponse is the content of the routes in use.
+type routesResponse struct {
+	Version  int               `json:"version"`
+	Checksum string            `json:"checksum"`
+	Routes   map[string]*route `json:"routes"`
+}
+
+// writeRoutesTable writes the routes of table with their checksum as ETag.
+func writeRoutesTable(w http.ResponseWriter, code int, table *routesTable) {
+	w.Header().Set("ETag", strconv.Quote(table.checksum))
+	writeAdminJSON(w, code, routesResponse{Version: table.version, Checksum: table.checksum, Routes: table.routes})
+}
+
+// parseIfMatch returns the routes checksum of the If-Match header.
+func parseIfMatch(r *http.Request) (string, bool) {
+	value := strings.TrimPrefix(strings.TrimSpace(r.Header.Get("If-Match")), "W/")
+	checksum := strings.Trim(value, `"`)
+	return checksum, checksum != ""
+}
+
+// authorized reports whether the request carries the admin bearer token.
+func authorized(r *http.Request, token string) bool {
+	given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// adminRoutesHandler serves the admin API of the routes. The route is given
+// by the route query parameter.
+//
+//	GET    /_admin/routes              list the routes and their ETag
+//	POST   /_admin/routes?route=/quiz  create a route
+//	PUT    /_admin/routes?route=/quiz  replace a route
+//	DELETE /_admin/routes?route=/quiz  delete a route
+func adminRoutesHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="routes admin"`)
+			writeAdminError(w, http.StatusUnauthorized, "missing or invalid admin token")
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			table := currentRoutes.Load()
+			if table == nil {
+				writeAdminError(w, http.StatusServiceUnavailable, "routes not loaded")
+				return
+			}
+			writeRoutesTable(w, http.StatusOK, table)
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+			writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		path := r.URL.Query().Get("route")
+		if path == "" {
+			writeAdminError(w, http.StatusBadRequest, "missing route query parameter")
+			return
+		}
+		checksum, found := parseIfMatch(r)
+		if !found {
+			writeAdminError(w, http.StatusPreconditionRequired, "missing If-Match header with the routes ETag")
+			return
+		}
+		var rt *route
+		if r.Method != http.MethodDelete {
+			decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRouteBody))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&rt); err != nil {
+				writeAdminError(w, http.StatusBadRequest, "invalid route - "+err.Error())
+				return
+			}
+			if err := validateRoute(path, rt); err != nil {
+				writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+		}
+
+		table, err := changeRoutes(checksum, func(routes map[string]*route) error {
+			_, exists := routes[path]
+			switch {
+			case r.Method == http.MethodPost && exists:
+				return errRouteExists
+			case r.Method != http.MethodPost && !exists:
+				return errRouteNotFound
+			case r.Method == http.MethodDelete:
+				delete(routes, path)
+			default:
+				routes[path] = rt
+			}
+			return nil
+		})
+		switch {
+		case err == nil && r.Method == http.MethodPost:
+			writeRoutesTable(w, http.StatusCreated, table)
+		case err == nil:
+			writeRoutesTable(w, http.StatusOK, table)
+		case errors.Is(err, errVersionConflict):
+			writeAdminError(w, http.StatusPreconditionFailed, err.Error())
+		case errors.Is(err, errRouteNotFound):
+			writeAdminError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, errRouteExists):
+			writeAdminError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, errPersist):
+			writeAdminError(w, http.StatusInternalServerError, err.Error())
+		default:
+			writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+// This file contains the click analytics of the routes. Each redirect is counted
+// per route and per day, along with the host of its referrer and the family of
+// the user agent. The counters are flushed periodically into a local json file
+// loaded back on start, and exposed as json and as Prometheus metrics.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxReferrers is the number of distinct referrers counted per route and
+	// day. Others are counted as "other" so a crawler cannot grow the file.
+	maxReferrers = 100
+	// directReferrer counts the clicks without referrer.
+	directReferrer = "direct"
+	// otherReferrer counts the referrers beyond maxReferrers.
+	otherReferrer = "other"
+)
+
+// dayClicks holds the clicks of a route during a day.
+type dayClicks struct {
+	Hits      int64            `json:"hits"`
+	Referrers map[string]int64 `json:"referrers"`
+	Agents    map[string]int64 `json:"agents"`
+}
+
+// routeClicks holds the clicks of a route.
+type routeClicks struct {
+	Total int64                 `json:"total"`
+	Days  map[string]*dayClicks `json:"days"`
+}
+
+// clickStats counts the clicks of every route. It is safe for concurrent use.
+type clickStats struct {
+	mu     sync.Mutex
+	routes map[string]*routeClicks
+	// dirty is set when clicks were counted since the last flush.
+	dirty bool
+}
+
+// clicks holds the click analytics of the web server.
+var clicks = newClickStats()
+
+// newClickStats returns empty click analytics.
+func newClickStats() *clickStats {
+	return &clickStats{routes: make(map[string]*routeClicks)}
+}
+
+// agentFamilies maps a marker of the user agent to its family, in the
+// order they are looked for since most browsers mention the others.
+var agentFamilies = []struct{ marker, family string }{
+	{"bot", "bot"}, {"crawler", "bot"}, {"spider", "bot"},
+	{"curl/", "curl"}, {"wget/", "wget"},
+	{"edg/", "edge"}, {"opr/", "opera"}, {"samsungbrowser/", "samsung"},
+	{"firefox/", "firefox"}, {"fxios/", "firefox"},
+	{"chrome/", "chrome"}, {"crios/", "chrome"},
+	{"safari/", "safari"},
+}
+
+// agentFamily returns the family of a user agent, like chrome or bot.
+func agentFamily(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	if ua == "" {
+		return "unknown"
+	}
+	for _, af := range agentFamilies {
+		if strings.Contains(ua, af.marker) {
+			return af.family
+		}
+	}
+	return "other"
+}
+
+// referrerHost returns the host of the referrer or "direct" if there is none.
+func referrerHost(referrer string) string {
+	u, err := url.Parse(referrer)
+	if referrer == "" || err != nil || u.Hostname() == "" {
+		return directReferrer
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// record counts a click of route.
+func (cs *clickStats) record(route string, r *http.Request, now time.Time) {
+	referrer, agent := referrerHost(r.Referer()), agentFamily(r.UserAgent())
+	day := now.UTC().Format(time.DateOnly)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	rc, found := cs.routes[route]
+	if !found {
+		rc = &routeClicks{Days: make(map[string]*dayClicks)}
+		cs.routes[route] = rc
+	}
+	dc, found := rc.Days[day]
+	if !found {
+		dc = &dayClicks{Referrers: make(map[string]int64), Agents: make(map[string]int64)}
+		rc.Days[day] = dc
+	}
+	if _, found := dc.Referrers[referrer]; !found && len(dc.Referrers) >= maxReferrers {
+		referrer = otherReferrer
+	}
+	rc.Total++
+	dc.Hits++
+	dc.Referrers[referrer]++
+	dc.Agents[agent]++
+	cs.dirty = true
+}
+
+// load adds the clicks saved into the file at path, if it exists.
+func (cs *clickStats) load(path string) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var routes map[string]*routeClicks
+	if err := json.Unmarshal(content, &routes); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for route, saved := range routes {
+		if saved == nil {
+			continue
+		}
+		rc, found := cs.routes[route]
+		if !found {
+			rc = &routeClicks{Days: make(map[string]*dayClicks)}
+			cs.routes[route] = rc
+		}
+		rc.Total += saved.Total
+		for day, sd := range saved.Days {
+			if sd == nil {
+				continue
+			}
+			dc, found := rc.Days[day]
+			if !found {
+				dc = &dayClicks{Referrers: make(map[string]int64), Agents: make(map[string]int64)}
+				rc.Days[day] = dc
+			}
+			dc.Hits += sd.Hits
+			for referrer, n := range sd.Referrers {
+				dc.Referrers[referrer] += n
+			}
+			for agent, n := range sd.Agents {
+				dc.Agents[agent] += n
+			}
+		}
+	}
+	return nil
+}
+
+// writeJSON writes the clicks of the routes, or of a single route if not
+// empty, as json.
+func (cs *clickStats) writeJSON(w io.Writer, route string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	routes := cs.routes
+	if route != "" {
+		routes = map[string]*routeClicks{}
+		if rc, found := cs.routes[route]; found {
+			routes[route] = rc
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(routes)
+}
+
+// flush saves the clicks into the file at path if new ones were counted.
+func (cs *clickStats) flush(path string) error {
+	var content bytes.Buffer
+	cs.mu.Lock()
+	dirty := cs.dirty
+	cs.dirty = false
+	cs.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	if err := cs.writeJSON(&content, ""); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, content.Bytes()); err != nil {
+		cs.mu.Lock()
+		cs.dirty = true
+		cs.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// flushEvery saves the clicks into the file at path every interval until
+// stop is closed, and a last time then.
+func (cs *clickStats) flushEvery(path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			if err := cs.flush(path); err != nil {
+				log.Println("[ Eror ] Failed to save click analytics. ErrMsg -", err)
+			}
+			return
+		}
+		if err := cs.flush(path); err != nil {
+			log.Println("[ Eror ] Failed to save click analytics. ErrMsg -", err)
+		}
+	}
+}
+
+// labelValue escapes a Prometheus label value.
+func labelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writeMetrics writes the clicks in the Prometheus text format. The days are
+// summed up since the scraping records the evolution over time.
+func (cs *clickStats) writeMetrics(w io.Writer) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	routes := make([]string, 0, len(cs.routes))
+	for route := range cs.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	sums := func(rc *routeClicks, counts func(dc *dayClicks) map[string]int64) ([]string, map[string]int64) {
+		total := make(map[string]int64)
+		for _, dc := range rc.Days {
+			for key, n := range counts(dc) {
+				total[key] += n
+			}
+		}
+		keys := make([]string, 0, len(total))
+		for key := range total {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys, total
+	}
+
+	fmt.Fprintln(w, "# HELP routes_clicks_total Number of redirects served per route.")
+	fmt.Fprintln(w, "# TYPE routes_clicks_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "routes_clicks_total{route=\"%s\"} %d\n", labelValue(route), cs.routes[route].Total)
+	}
+	fmt.Fprintln(w, "# HELP routes_clicks_by_referrer_total Number of redirects served per route and referrer host.")
+	fmt.Fprintln(w, "# TYPE routes_clicks_by_referrer_total counter")
+	for _, route := range routes {
+		keys, total := sums(cs.routes[route], func(dc *dayClicks) map[string]int64 { return dc.Referrers })
+		for _, referrer := range keys {
+			fmt.Fprintf(w, "routes_clicks_by_referrer_total{route=\"%s\",referrer=\"%s\"} %d\n", labelValue(route), labelValue(referrer), total[referrer])
+		}
+	}
+	fmt.Fprintln(w, "# HELP routes_clicks_by_agent_total Number of redirects served per route and user agent family.")
+	fmt.Fprintln(w, "# TYPE routes_clicks_by_agent_total counter")
+	for _, route := range routes {
+		keys, total := sums(cs.routes[route], func(dc *dayClicks) map[string]int64 { return dc.Agents })
+		for _, agent := range keys {
+			fmt.Fprintf(w, "routes_clicks_by_agent_total{route=\"%s\",agent=\"%s\"} %d\n", labelValue(route), labelValue(agent), total[agent])
+		}
+	}
+}
+
+// clickStatsHandler serves the clicks as json, of a single route with the
+// route query parameter. The content is built first so that a slow client
+// does not delay the counting.
+func clickStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var content bytes.Buffer
+	if err := clicks.writeJSON(&content, r.URL.Query().Get("route")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content.Bytes())
+}
+
+// metricsHandler serves the clicks as Prometheus metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var content bytes.Buffer
+	clicks.writeMetrics(&content)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(content.Bytes())
+}
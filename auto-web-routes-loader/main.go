@@ -1,109 +1,273 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
+	"flag"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
-var dynamicRoutes map[string]string
-var addRoutesMutex *sync.RWMutex
-var latestStat os.FileInfo
+// path of the json file holding the routes - set by -routes flag.
+var routesFilePath = "dynamic-routes.json"
 
-// intialization
-func init() {
+// bearer token of the admin API which is disabled when empty - set by
+// -admin-token flag or ROUTES_ADMIN_TOKEN environment variable.
+var adminToken = os.Getenv("ROUTES_ADMIN_TOKEN")
 
-	if dynamicRoutes == nil {
-		dynamicRoutes = make(map[string]string)
+// check every interval minute and update if changes. this polling is the
+// fallback of the event based watching.
+func updateDynamicRoutes(interval int) {
+	for {
+		time.Sleep(time.Duration(interval) * time.Minute)
+		reloadOnChange()
 	}
-
-	addRoutesMutex = &sync.RWMutex{}
-	loadDynamicRoutes() // initial loading of routes from file
 }
 
-// load and convert the json content into map
-func loadDynamicRoutes() {
+// reloadOnChange loads the routes file again if its content changed.
+func reloadOnChange() {
+	if _, err := reloadDynamicRoutes(false); err != nil {
+		log.Println("[ Eror ] Failed to reload dynamic routes - keeping the previous ones. ErrMsg -", err)
+	}
+}
 
-	routesFile, err := os.Open("dynamic-routes.json")
-	if err != nil {
-		log.Println("[ Eror ] Failed to load dynamic routes file. ErrMsg -", err)
-		os.Exit(1)
+// debounce returns a function which calls fn once no other call
+// happened during delay. Editors often write a file in several steps.
+func debounce(delay time.Duration, fn func()) func() {
+	var mu sync.Mutex
+	var timer *time.Timer
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.AfterFunc(delay, fn)
 	}
-	defer routesFile.Close()
-	latestStat, err = routesFile.Stat()
-	if err != nil {
-		log.Println("[ Eror ] Failed to get latest statistics of dynamic routes file. ErrMsg -", err)
-		return
+}
+
+// watchDynamicRoutes reloads the routes file on each change notified by the
+// system, when supported, and each time a SIGHUP signal is received.
+func watchDynamicRoutes(delay time.Duration) {
+	if _, err := watchRoutesFile(routesFilePath, debounce(delay, reloadOnChange)); err != nil {
+		log.Println("[ Eror ] Failed to watch dynamic routes file - relying on polling. ErrMsg -", err)
 	}
 
-	// convert the content into byte array
-	routesBytes, err := ioutil.ReadAll(routesFile)
-	if err != nil {
-		log.Println("[ Eror ] Failed to convert dynamic routes into map. ErrMsg -", err)
-		return
+	hupch := make(chan os.Signal, 1)
+	signal.Notify(hupch, syscall.SIGHUP)
+	for range hupch {
+		log.Println("received SIGHUP - reloading dynamic routes")
+		if err := loadDynamicRoutes(); err != nil {
+			log.Println("[ Eror ] Failed to reload dynamic routes - keeping the previous ones. ErrMsg -", err)
+		}
 	}
-	// lock the map to prevent race condition. enforce that
-	// reading happening from another goroutines
-	addRoutesMutex.Lock()
-
-	// if needed to reflect same state as file
-	// clean and recreate of the map like below
-	dynamicRoutes = nil
-	dynamicRoutes = make(map[string]string)
-
-	// construct the map from the json content (byte array)
-	err = json.Unmarshal([]byte(routesBytes), &dynamicRoutes)
-	if err != nil {
-		log.Println("[ Eror ] Failed to convert dynamic routes into map. ErrMsg -", err)
+}
+
+// checkDynamicRoutes is the not found handler of the web server. It redirects
+// to the target url when the requested path is a dynamic route.
+func checkDynamicRoutes(w http.ResponseWriter, r *http.Request) {
+
+	if rt, target, found := lookupRoute(r.URL.Path); found {
+		target, err := applyQueryPolicy(target, rt.Query, r.URL.RawQuery)
+		if err != nil {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+		clicks.record(rt.pattern, r, time.Now())
+		http.Redirect(w, r, target, rt.Status)
 		return
 	}
-	addRoutesMutex.Unlock()
+	// not found routine goes here
+	log.Println("unknown requested path - thank you.")
+	http.NotFound(w, r)
+}
+
+// reloadStatusHandler serves the outcome of the routes file reloads.
+func reloadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentStatus())
+}
 
-	// just displaying to check the content
-	addRoutesMutex.RLock()
-	for route, url := range dynamicRoutes {
-		log.Println("route", route, "url:", url)
+// newRouter returns the routes of the web server. Any request which does not
+// match a static route falls back on the dynamic routes.
+func newRouter() http.Handler {
+	router := http.NewServeMux()
+	router.HandleFunc("/_status", reloadStatusHandler)
+	router.HandleFunc("/_stats", clickStatsHandler)
+	router.HandleFunc("/_metrics", metricsHandler)
+	if adminToken != "" {
+		router.HandleFunc("/_admin/routes", adminRoutesHandler(adminToken))
 	}
-	log.Printf("Current Number Of Routes Is : %d\n\n", len(dynamicRoutes))
-	addRoutesMutex.RUnlock()
+	router.HandleFunc("/", checkDynamicRoutes)
+	return router
 }
 
-// check every interval minute and update if changes
-func updateDynamicRoutes(interval int) {
-	for {
-		stat, err := os.Stat("dynamic-routes.json")
-		if err != nil {
-			log.Println("[ Eror ] Failed to get statistics of dynamic routes file. ErrMsg -", err)
-		} else {
-			if stat.Size() != latestStat.Size() || stat.ModTime() != latestStat.ModTime() {
-				loadDynamicRoutes() // load only when size or latest modification time changed
-			}
+// starts the web server and shuts it down gracefully once exit is closed.
+// it returns once the server is fully stopped.
+func startWebServer(address string, exit <-chan struct{}) {
+
+	webserver := &http.Server{
+		Addr:         address,
+		Handler:      newRouter(),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	// goroutine in charge of shutting down the server when triggered.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-exit
+		log.Println("shutting down the web server ... please wait for 15 secs max")
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		if err := webserver.Shutdown(ctx); err != nil {
+			log.Println("[ Eror ] Failed to shutdown gracefully the web server. ErrMsg -", err)
 		}
-		time.Sleep(time.Duration(interval) * time.Minute)
+	}()
+
+	log.Printf("web server is starting on %s ...\n", address)
+	if err := webserver.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("[ Eror ] Failed to start the web server on %s. ErrMsg - %v\n", address, err)
 	}
+	// wait for the in-flight requests to complete.
+	<-stopped
 }
 
-// change this file dynamic-routes.json content and observe
+// change the routes file content and observe
 func main() {
-	doneChan := make(chan bool)
-	go updateDynamicRoutes(2) // check to update each 2 min if any changes
-	<-doneChan
+	address := flag.String("addr", "127.0.0.1:8080", "address where the web server listens")
+	flag.StringVar(&routesFilePath, "routes", routesFilePath, "path of the json file holding the dynamic routes")
+	interval := flag.Int("interval", 2, "minutes between two checks of the routes file for changes, in addition to the file events")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "bearer token of the admin API - disabled if empty - prefer ROUTES_ADMIN_TOKEN")
+	flag.BoolVar(&pathOptions.ignoreCase, "ignore-case", false, "match the routes regardless of the letters case of the path")
+	flag.BoolVar(&pathOptions.ignoreTrailingSlash, "ignore-trailing-slash", false, "match the routes regardless of a trailing slash of the path")
+	statsFile := flag.String("stats-file", "click-stats.json", "file where the click analytics are saved - disabled if empty")
+	statsFlush := flag.Duration("stats-flush", time.Minute, "delay between two saves of the click analytics")
+	delay := flag.Duration("debounce", 250*time.Millisecond, "delay without file events before the routes file is reloaded")
+	flag.Parse()
+
+	if *interval < 1 {
+		log.Println("[ Eror ] Invalid interval. ErrMsg - it must be at least 1 minute, got", *interval)
+		os.Exit(1)
+	}
+	if *statsFlush <= 0 {
+		log.Println("[ Eror ] Invalid stats flush delay. ErrMsg - it must be positive, got", *statsFlush)
+		os.Exit(1)
+	}
+
+	// initial loading of routes from file
+	if err := loadDynamicRoutes(); err != nil {
+		log.Println("[ Eror ] Failed to load dynamic routes. ErrMsg -", err)
+		os.Exit(1)
+	}
+	go updateDynamicRoutes(*interval) // check to update each interval min if any changes
+	go watchDynamicRoutes(*delay)
+
+	exit := make(chan struct{})
+	go func() {
+		sigch := make(chan os.Signal, 1)
+		signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+		<-sigch
+		close(exit)
+	}()
+
+	// click analytics survive restarts through the stats file.
+	flushed := make(chan struct{})
+	if *statsFile != "" {
+		if err := clicks.load(*statsFile); err != nil {
+			log.Println("[ Eror ] Failed to load click analytics. ErrMsg -", err)
+			os.Exit(1)
+		}
+		stopFlush := make(chan struct{})
+		go func() {
+			clicks.flushEvery(*statsFile, *statsFlush, stopFlush)
+			close(flushed)
+		}()
+		defer func() {
+			close(stopFlush)
+			<-flushed
+		}()
+	}
+	startWebServer(*address, exit)
 }
 
-/* function to call into your NOTFOUND HANDLER for checking dynamic routes
-func checkDynamicRoutes(w http.ResponseWriter, r *http.Request) {
+/*
 
-	addRoutesMutex.Rlock()
-	if targetURL, found := dynamicRoutes[r.URL.String()]; found {
-		addRoutesMutex.RUnlock()
-		http.Redirect(w, r, targetURL, http.StatusMovedPermanently)
-		return
-	} else {
-		// not found routine goes here
-		log.Println("unknown requested path - thank you.")
+~$ go run . -addr 127.0.0.1:8080 -routes dynamic-routes.json
+~$ curl -i localhost:8080/youtube
+HTTP/1.1 301 Moved Permanently
+Location: https://www.youtube.com/c/AmonTLC2014/videos
+
+~$ curl -i localhost:8080/unknown
+HTTP/1.1 404 Not Found
+
+// routes can use the versioned format of the routes file to set their redirect status code
+// and the period they are served. the flat format above still loads with 301 redirects.
+
+{
+	"version": 2,
+	"routes": {
+		"/quiz": {"target": "https://cloudmentor-scale.com:8088/cisco-skills-challenger/", "status": 302, "owner": "jerome"},
+		"/black-friday": {"target": "/blog", "status": 307, "not_before": "2024-11-29T00:00:00Z", "expires_at": "2024-12-02T00:00:00Z"},
+		"/chat": {"target": "https://play.google.com/store/apps/details?id=com.amon.ChatAtScaleMobile", "enabled": false, "notes": "app unpublished"},
+		"/docs/": {"target": "https://cloudmentor-scale.com/docs/$1", "match": "prefix"},
+		"/quiz-*": {"target": "https://cloudmentor-scale.com:8088/quiz/?platform=$1", "match": "glob"},
+		"/(tuto|tutorial|tutoriel|training|formation)": {"target": "https://www.youtube.com/channel/UCtdmdmlyeT38R1maCXWuA0g/videos", "match": "regex"}
 	}
 }
+
+// an exact route wins over the patterns. then prefix routes are tried, then glob routes and
+// then regex routes - the one with the longest literal beginning first. captures of the path
+// are substituted into the target as $1 or ${name} - use $$ for a literal $ in a pattern target.
+
+// routes match the path only. the query of the request is dropped unless the route policy
+// says to pass it as is or to merge the parameters the target does not set already.
+
+"/apps": {"target": "https://play.google.com/store/apps/developer?id=Jerome+AMON&hl=en", "query": "merge"}
+
+~$ go run . -ignore-case -ignore-trailing-slash
+~$ curl -i 'localhost:8080/Apps/?hl=fr&utm_source=blog'
+HTTP/1.1 301 Moved Permanently
+Location: https://play.google.com/store/apps/developer?id=Jerome+AMON&hl=en&utm_source=blog
+
+// the routes can be managed through the admin API. each change must give the ETag it is
+// based on - the checksum of the routes file content - and is validated then applied and
+// saved into the routes file - in the versioned format.
+
+~$ ROUTES_ADMIN_TOKEN=secret go run .
+~$ curl -i -H 'Authorization: Bearer secret' localhost:8080/_admin/routes
+ETag: "5f1c0d3e9a..."
+{"version":1,"checksum":"5f1c0d3e9a...","routes":{"/apps":{"target":"https://play.google.com/store/apps/developer?id=Jerome+AMON\u0026hl=en","status":301,"match":"exact","query":"drop"}, ...}}
+~$ curl -X POST -H 'Authorization: Bearer secret' -H 'If-Match: "5f1c0d3e9a..."' -d '{"target": "https://cloudmentor-scale.com/news", "status": 302}' 'localhost:8080/_admin/routes?route=/news'
+~$ curl -X DELETE -H 'Authorization: Bearer secret' -H 'If-Match: "5f1c0d3e9a..."' 'localhost:8080/_admin/routes?route=/chat'
+{"error":"the routes changed since the given ETag"}
+
+// each redirect is counted per route and day with its referrer host and user agent family.
+// counters are saved into -stats-file every -stats-flush and on exit.
+
+~$ curl localhost:8080/_stats?route=/youtube
+{"/youtube":{"total":3,"days":{"2024-05-02":{"hits":3,"referrers":{"direct":1,"t.co":2},"agents":{"chrome":2,"curl":1}}}}}
+~$ curl localhost:8080/_metrics
+# HELP routes_clicks_total Number of redirects served per route.
+# TYPE routes_clicks_total counter
+routes_clicks_total{route="/youtube"} 3
+...
+routes_clicks_by_agent_total{route="/youtube",agent="chrome"} 2
+
+// the routes file is reloaded as soon as it is saved, or on demand.
+
+~$ kill -HUP $(pidof auto-web-routes-loader)
+
+// a broken routes file is reported and the previous routes keep being served.
+
+~$ curl localhost:8080/_status
+{"version":2,"routes":20,"checksum":"5f1c0d3e9a...","last_success":"2024-05-02T10:12:03Z","last_error":"invalid dynamic routes file: route \"blog\" must start with /","last_error_at":"2024-05-02T10:14:03Z"}
+
 */
@@ -0,0 +1,525 @@
+package main
+
+// Basic test file for <auto-web-routes-loader> snippet.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeRoutes writes the routes file content and loads it.
+func writeRoutes(t *testing.T, content string) {
+	t.Helper()
+	if err := os.WriteFile(routesFilePath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDynamicRoutes(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckDynamicRoutes(t *testing.T) {
+	routesFilePath = filepath.Join(t.TempDir(), "dynamic-routes.json")
+	writeRoutes(t, `{"/blog": "https://example.com/blog"}`)
+	testServer := httptest.NewServer(newRouter())
+	defer testServer.Close()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	t.Run("known route is redirected", func(t *testing.T) {
+		resp, err := client.Get(testServer.URL + "/blog")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("expected status %d but got %d", http.StatusMovedPermanently, resp.StatusCode)
+		}
+		if location := resp.Header.Get("Location"); location != "https://example.com/blog" {
+			t.Errorf("unexpected location %q", location)
+		}
+	})
+
+	t.Run("unknown route is not found", func(t *testing.T) {
+		resp, err := client.Get(testServer.URL + "/unknown")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %d but got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+
+	t.Run("reload during requests", func(t *testing.T) {
+		targets := []string{"https://example.com/one", "https://example.com/two"}
+		var wg sync.WaitGroup
+		errs := make(chan error, 100)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 25; j++ {
+					resp, err := client.Get(testServer.URL + "/blog")
+					if err != nil {
+						errs <- err
+						return
+					}
+					resp.Body.Close()
+					location := resp.Header.Get("Location")
+					if resp.StatusCode != http.StatusMovedPermanently || (location != "https://example.com/blog" && location != targets[0] && location != targets[1]) {
+						errs <- fmt.Errorf("unexpected response %d to %q", resp.StatusCode, location)
+					}
+				}
+			}()
+		}
+		for i := 0; i < 20; i++ {
+			writeRoutes(t, fmt.Sprintf(`{"/blog": %q, "/other": "https://example.com/other"}`, targets[i%2]))
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+	})
+
+	t.Run("versioned routes", func(t *testing.T) {
+		writeRoutes(t, `{"version": 2, "routes": {
+			"/temp": {"target": "https://example.com/temp", "status": 307, "owner": "ops"},
+			"/off": {"target": "https://example.com/off", "enabled": false},
+			"/old": {"target": "https://example.com/old", "expires_at": "2000-01-01T00:00:00Z"},
+			"/soon": {"target": "https://example.com/soon", "not_before": "2999-01-01T00:00:00Z"}
+		}}`)
+		tests := map[string]int{"/temp": http.StatusTemporaryRedirect, "/off": http.StatusNotFound, "/old": http.StatusNotFound, "/soon": http.StatusNotFound}
+		for path, code := range tests {
+			resp, err := client.Get(testServer.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != code {
+				t.Errorf("%s: expected status %d but got %d", path, code, resp.StatusCode)
+			}
+		}
+		if _, err := parseRoutes([]byte(`{"version": 2, "routes": {"/x": {"target": "/y", "status": 200}}}`)); err == nil {
+			t.Error("expected an error for an unsupported status code")
+		}
+	})
+
+	t.Run("same size edit is reloaded", func(t *testing.T) {
+		writeRoutes(t, `{"/blog": "https://example.com/aaaa"}`)
+		if reloaded, err := reloadDynamicRoutes(false); err != nil || reloaded {
+			t.Fatalf("expected no reload of the same content but got %v, %v", reloaded, err)
+		}
+		if err := os.WriteFile(routesFilePath, []byte(`{"/blog": "https://example.com/bbbb"}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if reloaded, err := reloadDynamicRoutes(false); err != nil || !reloaded {
+			t.Fatalf("expected a reload but got %v, %v", reloaded, err)
+		}
+	})
+
+	t.Run("invalid file keeps the last known good routes", func(t *testing.T) {
+		writeRoutes(t, `{"/blog": "https://example.com/blog"}`)
+		before := currentStatus()
+		for _, content := range []string{`{"/blog": "https://example`, `{"/blog": "ftp://example.com", "news": "/blog"}`} {
+			if err := os.WriteFile(routesFilePath, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadDynamicRoutes(); err == nil {
+				t.Fatalf("expected an error loading %s", content)
+			}
+		}
+		resp, err := client.Get(testServer.URL + "/blog")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "https://example.com/blog" {
+			t.Errorf("unexpected location %q", location)
+		}
+		after := currentStatus()
+		if after.Version != before.Version || after.LastError == "" || after.LastErrorAt == nil {
+			t.Errorf("unexpected reload status %+v", after)
+		}
+	})
+}
+
+func TestWatchRoutesFile(t *testing.T) {
+	base := t.TempDir()
+	for _, dir := range []string{"v1", "v2"} {
+		if err := os.Mkdir(filepath.Join(base, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		content := fmt.Sprintf(`{"/blog": "https://example.com/%s"}`, dir)
+		if err := os.WriteFile(filepath.Join(base, dir, "routes.json"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("v1", filepath.Join(base, "current")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(base, "current", "routes.json")
+	events := make(chan struct{}, 16)
+	stop, err := watchRoutesFile(path, func() { events <- struct{}{} })
+	if err != nil {
+		t.Skip("watching is not supported:", err)
+	}
+	defer stop()
+
+	waitEvent := func(t *testing.T) {
+		t.Helper()
+		select {
+		case <-events:
+		case <-time.After(2 * time.Second):
+			t.Fatal("no change notified")
+		}
+		// drain the other events of the same change.
+		time.Sleep(50 * time.Millisecond)
+		for len(events) > 0 {
+			<-events
+		}
+	}
+
+	t.Run("save through rename", func(t *testing.T) {
+		tmp := filepath.Join(base, "v1", ".routes.json.swp")
+		if err := os.WriteFile(tmp, []byte(`{"/blog": "https://example.com/edited"}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+		waitEvent(t)
+	})
+
+	t.Run("swap of a directory link", func(t *testing.T) {
+		link := filepath.Join(base, "current.tmp")
+		if err := os.Symlink("v2", link); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(link, filepath.Join(base, "current")); err != nil {
+			t.Fatal(err)
+		}
+		waitEvent(t)
+	})
+
+	t.Run("edit after the swap", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(base, "v2", "routes.json"), []byte(`{}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		waitEvent(t)
+	})
+
+	t.Run("unrelated file is ignored", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(base, "v2", "other.json"), []byte(`{}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-events:
+			t.Error("unexpected notification")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+}
+
+func TestMatcher(t *testing.T) {
+	routes, err := parseRoutes([]byte(`{"version": 2, "routes": {
+		"/docs": {"target": "https://example.com/exact"},
+		"/docs/": {"target": "https://example.com/docs/$1", "match": "prefix"},
+		"/docs/api/": {"target": "https://api.example.com/$1", "match": "prefix"},
+		"/docs/*.pdf": {"target": "https://example.com/pdf/$1", "match": "glob"},
+		"/files/**/*.zip": {"target": "https://cdn.example.com/$1/$2.zip", "match": "glob"},
+		"/(tuto|tutorial|training)": {"target": "https://example.com/videos?from=$1", "match": "regex"},
+		"/u/(?P<user>[a-z]+)": {"target": "https://example.com/users/${user}", "match": "regex"},
+		"/g**": {"target": "https://example.com/any/$1", "match": "glob"},
+		"/guides/*/*.html": {"target": "https://example.com/guides/$1/$2", "match": "glob"},
+		"/r.*": {"target": "https://example.com/any", "match": "regex"},
+		"^/reports/(\\d+)/(.*)": {"target": "https://example.com/reports/$1/$2", "match": "regex"}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMatcher(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"/docs":               "https://example.com/exact",
+		"/docs/intro":         "https://example.com/docs/intro",
+		"/docs/api/v1":        "https://api.example.com/v1",
+		"/docs/guide.pdf":     "https://example.com/docs/guide.pdf",
+		"/files/a/b/pack.zip": "https://cdn.example.com/a/b/pack.zip",
+		"/training":           "https://example.com/videos?from=training",
+		"/u/jerome":           "https://example.com/users/jerome",
+		"/u/Jerome":           "",
+		"/tutorials":          "",
+		"/guides/a/b.html":    "https://example.com/guides/a/b",
+		"/guides/a/b/c.html":  "https://example.com/any/uides/a/b/c.html",
+		"/reports/2024/q1":    "https://example.com/reports/2024/q1",
+		"/reports/last/q1":    "https://example.com/any",
+	}
+	for path, want := range tests {
+		_, got, found := m.match(path, time.Now())
+		if found != (want != "") || got != want {
+			t.Errorf("%s: expected %q but got %q", path, want, got)
+		}
+	}
+
+	literals := map[string]string{
+		"/files/**/*.zip":           "/files/",
+		"/guides/*/*.html":          "/guides/",
+		"/(tuto|tutorial|training)": "/t",
+		"/u/(?P<user>[a-z]+)":       "/u/",
+		"^/reports/(\\d+)/(.*)":     "/reports/",
+	}
+	for pattern, want := range literals {
+		if got := routes[pattern].literal; got != want {
+			t.Errorf("%s: expected the literal %q but got %q", pattern, want, got)
+		}
+	}
+}
+
+func TestApplyQueryPolicy(t *testing.T) {
+	tests := []struct {
+		policy, target, query, want string
+	}{
+		{queryDrop, "https://example.com/a?x=1", "ref=blog", "https://example.com/a?x=1"},
+		{queryPass, "https://example.com/a?x=1", "x=2&ref=blog", "https://example.com/a?x=1&x=2&ref=blog"},
+		{queryPass, "/blog#top", "ref=mail", "/blog?ref=mail#top"},
+		{queryMerge, "https://example.com/a?x=1", "x=2&ref=blog", "https://example.com/a?x=1&ref=blog"},
+		{queryMerge, "https://example.com/a?x=1", "x=2", "https://example.com/a?x=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.query, func(t *testing.T) {
+			got, err := applyQueryPolicy(tt.target, tt.policy, tt.query)
+			if err != nil || got != tt.want {
+				t.Errorf("expected %q but got %q, %v", tt.want, got, err)
+			}
+		})
+	}
+}
+
+func TestPathNormalisation(t *testing.T) {
+	pathOptions.ignoreCase, pathOptions.ignoreTrailingSlash = true, true
+	defer func() { pathOptions.ignoreCase, pathOptions.ignoreTrailingSlash = false, false }()
+
+	routes, err := parseRoutes([]byte(`{"version": 2, "routes": {
+		"/Quiz/": {"target": "https://example.com/quiz"},
+		"/u/*": {"target": "https://example.com/users/$1", "match": "glob"},
+		"/docs/": {"target": "https://example.com/docs/$1", "match": "prefix"}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMatcher(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"/quiz":        "https://example.com/quiz",
+		"/QUIZ/":       "https://example.com/quiz",
+		"/U/Jerome":    "https://example.com/users/Jerome",
+		"/docs/":       "https://example.com/docs/",
+		"/docs":        "https://example.com/docs/",
+		"/Docs/Intro/": "https://example.com/docs/Intro",
+		"/docs/a/b":    "https://example.com/docs/a/b",
+		"/docsx":       "",
+	}
+	for path, want := range tests {
+		if _, got, _ := m.match(path, time.Now()); got != want {
+			t.Errorf("%s: expected %q but got %q", path, want, got)
+		}
+	}
+
+	routes, err = parseRoutes([]byte(`{"/quiz": "https://example.com/a", "/QUIZ/": "https://example.com/b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newMatcher(routes); err == nil {
+		t.Error("expected an error for routes which are the same once normalised")
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	routesFilePath = filepath.Join(t.TempDir(), "dynamic-routes.json")
+	writeRoutes(t, `{"/blog": "https://example.com/blog"}`)
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+	testServer := httptest.NewServer(newRouter())
+	defer testServer.Close()
+
+	do := func(t *testing.T, method, route, version, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, testServer.URL+"/_admin/routes?route="+route, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		if version != "" {
+			req.Header.Set("If-Match", version)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	version := func() string { return fmt.Sprintf("%q", currentRoutes.Load().checksum) }
+
+	t.Run("missing token is rejected", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/_admin/routes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status %d but got %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+
+	t.Run("created route is served and persisted", func(t *testing.T) {
+		resp := do(t, http.MethodPost, "/news", version(), `{"target": "https://example.com/news", "status": 302}`)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("expected status %d but got %d", http.StatusCreated, resp.StatusCode)
+		}
+		if rt, target, found := lookupRoute("/news"); !found || target != "https://example.com/news" || rt.Status != http.StatusFound {
+			t.Errorf("unexpected route %+v %q", rt, target)
+		}
+		content, err := os.ReadFile(routesFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes, err := parseRoutes(content)
+		if err != nil || len(routes) != 2 || routes["/news"].Target != "https://example.com/news" {
+			t.Errorf("unexpected persisted routes %v, %v", routes, err)
+		}
+		if reloaded, err := reloadDynamicRoutes(false); reloaded || err != nil {
+			t.Errorf("expected the persisted file to be up to date but got %v, %v", reloaded, err)
+		}
+	})
+
+	t.Run("stale version is rejected", func(t *testing.T) {
+		stale := version()
+		if resp := do(t, http.MethodPut, "/news", stale, `{"target": "https://example.com/v2"}`); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+		}
+		if resp := do(t, http.MethodDelete, "/news", stale, ""); resp.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("expected status %d but got %d", http.StatusPreconditionFailed, resp.StatusCode)
+		}
+		if resp := do(t, http.MethodDelete, "/news", "", ""); resp.StatusCode != http.StatusPreconditionRequired {
+			t.Errorf("expected status %d but got %d", http.StatusPreconditionRequired, resp.StatusCode)
+		}
+	})
+
+	t.Run("etag is the content checksum", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, testServer.URL+"/_admin/routes", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		content, err := os.ReadFile(routesFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(content)
+		etag := fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+		if got := resp.Header.Get("ETag"); got != etag {
+			t.Errorf("expected the ETag %s but got %s", etag, got)
+		}
+		// an identical reload, like on restart or SIGHUP, keeps the ETag valid.
+		if err := loadDynamicRoutes(); err != nil {
+			t.Fatal(err)
+		}
+		if resp := do(t, http.MethodPut, "/news", etag, `{"target": "https://example.com/v3"}`); resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+		}
+	})
+
+	t.Run("invalid route is rejected", func(t *testing.T) {
+		if resp := do(t, http.MethodPut, "/news", version(), `{"target": "ftp://example.com"}`); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("expected status %d but got %d", http.StatusUnprocessableEntity, resp.StatusCode)
+		}
+	})
+
+	t.Run("reserved route is rejected", func(t *testing.T) {
+		for _, route := range []string{"/_stats", "/_admin/routes", "/_new"} {
+			if resp := do(t, http.MethodPost, route, version(), `{"target": "https://example.com"}`); resp.StatusCode != http.StatusUnprocessableEntity {
+				t.Errorf("%s: expected status %d but got %d", route, http.StatusUnprocessableEntity, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("deleted route is not found", func(t *testing.T) {
+		if resp := do(t, http.MethodDelete, "/news", version(), ""); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d but got %d", http.StatusOK, resp.StatusCode)
+		}
+		if _, _, found := lookupRoute("/news"); found {
+			t.Error("expected the route to be deleted")
+		}
+	})
+}
+
+func TestClickStats(t *testing.T) {
+	cs := newClickStats()
+	now := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	for _, h := range []struct{ referrer, agent string }{
+		{"https://t.co/abc", "Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 Chrome/124.0 Safari/537.36"},
+		{"https://T.co/xyz", "Mozilla/5.0 (iPhone) AppleWebKit/605.1.15 Version/17.0 Mobile/15E148 Safari/604.1"},
+		{"", "curl/8.5.0"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/youtube", nil)
+		r.Header.Set("Referer", h.referrer)
+		r.Header.Set("User-Agent", h.agent)
+		cs.record("/youtube", r, now)
+	}
+
+	day := cs.routes["/youtube"].Days["2024-05-02"]
+	if cs.routes["/youtube"].Total != 3 || day.Referrers["t.co"] != 2 || day.Referrers[directReferrer] != 1 {
+		t.Errorf("unexpected referrers %v", day.Referrers)
+	}
+	if day.Agents["chrome"] != 1 || day.Agents["safari"] != 1 || day.Agents["curl"] != 1 {
+		t.Errorf("unexpected agents %v", day.Agents)
+	}
+
+	var metrics strings.Builder
+	cs.writeMetrics(&metrics)
+	for _, line := range []string{
+		`routes_clicks_total{route="/youtube"} 3`,
+		`routes_clicks_by_referrer_total{route="/youtube",referrer="t.co"} 2`,
+		`routes_clicks_by_agent_total{route="/youtube",agent="curl"} 1`,
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Errorf("missing metric %s", line)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "click-stats.json")
+	if err := cs.flush(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := newClickStats()
+	if err := restored.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.routes["/youtube"].Days["2024-05-02"].Hits; got != 3 {
+		t.Errorf("expected 3 restored hits but got %d", got)
+	}
+}
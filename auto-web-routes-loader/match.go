@@ -0,0 +1,244 @@
+package main
+
+// This file contains the matching of the requested paths against the routes.
+// Besides exact routes, a route can match every path starting with a prefix,
+// a glob pattern or a regular expression, and the captured parts of the path
+// are substituted into its target as $1, $2 or ${name}.
+//
+// Precedence: an exact route always wins. Then prefix routes are tried, then
+// glob routes, then regex routes. Within a kind the route with the longest
+// literal beginning wins, like /docs/api/ over /docs/, and routes with the
+// same literal beginning are tried in the lexicographic order of their pattern.
+// Patterns are indexed by their literal beginning so only the routes sharing
+// a beginning with the path are evaluated, which keeps large tables fast.
+// Only the path of the request is matched: the query is handled by the route
+// policy. The trailing slash and the letters case can be ignored by options.
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the kinds of route matching.
+const (
+	matchExact  = "exact"
+	matchPrefix = "prefix"
+	matchGlob   = "glob"
+	matchRegex  = "regex"
+)
+
+// globToRegexp returns the regular expression of a glob pattern where ** matches
+// anything, * matches within a path segment and ? matches a single character.
+// Each wildcard is a capture group.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString("(.*)")
+			i++
+		case glob[i] == '*':
+			b.WriteString("([^/]*)")
+		case glob[i] == '?':
+			b.WriteString("([^/])")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// regexLiteral returns the literal beginning of every string matched by re
+// and whether re matches nothing more than this literal.
+func regexLiteral(re *syntax.Regexp) (string, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return "", false
+		}
+		return string(re.Rune), true
+	case syntax.OpEmptyMatch, syntax.OpBeginText:
+		return "", true
+	case syntax.OpCapture:
+		return regexLiteral(re.Sub[0])
+	case syntax.OpConcat:
+		var b strings.Builder
+		for _, sub := range re.Sub {
+			literal, complete := regexLiteral(sub)
+			b.WriteString(literal)
+			if !complete {
+				return b.String(), false
+			}
+		}
+		return b.String(), true
+	}
+	return "", false
+}
+
+// patternLiteral returns the literal beginning of a pattern route, the
+// text before its first wildcard or regular expression operator.
+func patternLiteral(pattern, match string) string {
+	switch match {
+	case matchGlob:
+		if i := strings.IndexAny(pattern, "*?"); i >= 0 {
+			return pattern[:i]
+		}
+	case matchRegex:
+		re, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			return ""
+		}
+		literal, _ := regexLiteral(re.Simplify())
+		return literal
+	}
+	return pattern
+}
+
+// pathOptions holds the normalisation of the paths before matching - set by flags.
+var pathOptions struct {
+	// ignoreCase matches the paths regardless of their ascii letters case.
+	ignoreCase bool
+	// ignoreTrailingSlash matches /quiz/ like /quiz.
+	ignoreTrailingSlash bool
+}
+
+// normalizePath removes the trailing slash of path when it is ignored.
+func normalizePath(path string) string {
+	if pathOptions.ignoreTrailingSlash && len(path) > 1 {
+		return strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+// foldCase returns the key of path into the routes indexes: path itself or
+// its ascii letters lowered when the case is ignored. The length is kept so
+// positions into the key are positions into the path.
+func foldCase(path string) string {
+	if !pathOptions.ignoreCase {
+		return path
+	}
+	b := []byte(path)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// compileRoute prepares the matching of a pattern route.
+func compileRoute(pattern string, rt *route) error {
+	rt.pattern = pattern
+	var expr string
+	switch rt.Match {
+	case "", matchExact:
+		rt.Match = matchExact
+		rt.literal = foldCase(normalizePath(pattern))
+		return nil
+	case matchPrefix:
+		expr = regexp.QuoteMeta(pattern) + "(.*)"
+		if trimmed := normalizePath(pattern); trimmed != pattern {
+			// the path is matched without its trailing slash so the pattern
+			// is too: /docs/ matches /docs and /docs/intro but not /docsx.
+			pattern = trimmed
+			expr = regexp.QuoteMeta(pattern) + "(?:/(.*))?"
+		}
+	case matchGlob:
+		pattern = normalizePath(pattern)
+		expr = globToRegexp(pattern)
+	case matchRegex:
+		expr = pattern
+	default:
+		return fmt.Errorf("unknown match %q - expected exact, prefix, glob or regex", rt.Match)
+	}
+	expr = `(?s)^(?:` + expr + `)$`
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	rt.literal = foldCase(patternLiteral(pattern, rt.Match))
+	if pathOptions.ignoreCase {
+		re = regexp.MustCompile(`(?i)` + expr)
+	}
+	rt.re = re
+	return nil
+}
+
+// patternIndex holds the routes of a kind indexed by their literal beginning.
+type patternIndex map[string][]*route
+
+// sort orders the routes of a same beginning by their pattern.
+func (idx patternIndex) sort() {
+	for _, routes := range idx {
+		sort.Slice(routes, func(i, j int) bool { return routes[i].pattern < routes[j].pattern })
+	}
+}
+
+// lookup returns the active route matching path with the longest literal
+// beginning and the positions of its captures.
+func (idx patternIndex) lookup(path string, now time.Time) (*route, []int) {
+	if len(idx) == 0 {
+		return nil, nil
+	}
+	key := foldCase(path)
+	for i := len(key); i >= 0; i-- {
+		for _, rt := range idx[key[:i]] {
+			if m := rt.re.FindStringSubmatchIndex(path); m != nil && rt.active(now) {
+				return rt, m
+			}
+		}
+	}
+	return nil, nil
+}
+
+// matcher finds the route of a path.
+type matcher struct {
+	exact map[string]*route
+	// patterns holds the indexes in order of precedence.
+	patterns []patternIndex
+}
+
+// newMatcher indexes the validated routes. It fails when exact routes
+// are the same once normalised, like /quiz and /Quiz/.
+func newMatcher(routes map[string]*route) (*matcher, error) {
+	m := &matcher{exact: make(map[string]*route)}
+	indexes := map[string]patternIndex{matchPrefix: {}, matchGlob: {}, matchRegex: {}}
+	for _, rt := range routes {
+		if rt.Match == matchExact {
+			if other, found := m.exact[rt.literal]; found {
+				a, b := other.pattern, rt.pattern
+				if b < a {
+					a, b = b, a
+				}
+				return nil, fmt.Errorf("routes %q and %q are the same path once normalised", a, b)
+			}
+			m.exact[rt.literal] = rt
+			continue
+		}
+		indexes[rt.Match][rt.literal] = append(indexes[rt.Match][rt.literal], rt)
+	}
+	m.patterns = []patternIndex{indexes[matchPrefix], indexes[matchGlob], indexes[matchRegex]}
+	for _, idx := range m.patterns {
+		idx.sort()
+	}
+	return m, nil
+}
+
+// match returns the active route of path and its target with the captures
+// of the path substituted. The path is normalised first.
+func (m *matcher) match(path string, now time.Time) (*route, string, bool) {
+	path = normalizePath(path)
+	if rt, found := m.exact[foldCase(path)]; found && rt.active(now) {
+		return rt, rt.Target, true
+	}
+	for _, idx := range m.patterns {
+		if rt, captures := idx.lookup(path, now); rt != nil {
+			return rt, string(rt.re.ExpandString(nil, rt.Target, path, captures)), true
+		}
+	}
+	return nil, "", false
+}
@@ -0,0 +1,64 @@
+package main
+
+// This file contains the query policies of the routes which decide what becomes
+// of the query of the request on redirect. The fragment of a link is never sent
+// to the server: the fragment of the target is kept, and when the target has
+// none browsers keep the fragment of the original link across the redirect.
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// the query policies of a route.
+const (
+	// queryDrop ignores the query of the request. It is the default.
+	queryDrop = "drop"
+	// queryPass appends the query of the request as is to the target query.
+	queryPass = "pass"
+	// queryMerge adds the parameters of the request which the target
+	// query does not set already.
+	queryMerge = "merge"
+)
+
+// validateQueryPolicy checks the policy and returns it with its default.
+func validateQueryPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return queryDrop, nil
+	case queryDrop, queryPass, queryMerge:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown query policy %q - expected drop, pass or merge", policy)
+}
+
+// applyQueryPolicy returns the target carrying the query of the request
+// according to the policy.
+func applyQueryPolicy(target, policy, rawQuery string) (string, error) {
+	if policy == queryDrop || rawQuery == "" {
+		return target, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if policy == queryMerge {
+		incoming, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return "", err
+		}
+		existing := u.Query()
+		for key := range existing {
+			delete(incoming, key)
+		}
+		rawQuery = incoming.Encode()
+	}
+	switch {
+	case rawQuery == "":
+	case u.RawQuery == "":
+		u.RawQuery = rawQuery
+	default:
+		u.RawQuery += "&" + rawQuery
+	}
+	return u.String(), nil
+}
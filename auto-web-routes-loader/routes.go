@@ -0,0 +1,138 @@
+package main
+
+// This file contains the loading of the dynamic routes. The routes file is parsed
+// and validated into a fresh table which is published atomically only when every
+// route is valid, so requests always see a complete table and a broken file keeps
+// the last known good routes in place.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// routesTable is a loaded generation of the dynamic routes. It is never
+// modified once published so it is read without locking.
+type routesTable struct {
+	routes  map[string]*route
+	matcher *matcher
+	version int
+	// checksum is the hex sha256 of the routes file content. Unlike the
+	// version, it stays the same across restarts and identical reloads.
+	checksum string
+	loadedAt time.Time
+}
+
+// reloadStatus describes the outcome of the routes file reloads.
+type reloadStatus struct {
+	Version     int        `json:"version"`
+	Routes      int        `json:"routes"`
+	Checksum    string     `json:"checksum"`
+	LastSuccess time.Time  `json:"last_success"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// currentRoutes holds the routes table in use.
+var currentRoutes atomic.Pointer[routesTable]
+
+var (
+	// reloadMutex serializes the reloads and protects below states.
+	reloadMutex sync.Mutex
+	status      reloadStatus
+	// latestSum is the checksum of the routes file content last read.
+	latestSum [sha256.Size]byte
+)
+
+// loadDynamicRoutes reads, validates then publishes the routes file content.
+// On failure the routes in use are kept and the error is recorded into the
+// reload status.
+func loadDynamicRoutes() error {
+	_, err := reloadDynamicRoutes(true)
+	return err
+}
+
+// reloadDynamicRoutes loads the routes file like loadDynamicRoutes but, unless
+// force is set, only when its content differs from the one last read. It
+// reports whether a new table was published.
+func reloadDynamicRoutes(force bool) (bool, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	content, err := os.ReadFile(routesFilePath)
+	if err != nil {
+		err = fmt.Errorf("failed to read dynamic routes file: %w", err)
+		recordFailure(err)
+		return false, err
+	}
+	// the content is compared rather than the file size and modification
+	// time which miss a same size edit done within the same second.
+	sum := sha256.Sum256(content)
+	if !force && sum == latestSum {
+		return false, nil
+	}
+	// the checksum is recorded even if the content is invalid so that
+	// the same broken content is not loaded again.
+	latestSum = sum
+
+	routes, err := parseRoutes(content)
+	var m *matcher
+	if err == nil {
+		m, err = newMatcher(routes)
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid dynamic routes file: %w", err)
+		recordFailure(err)
+		return false, err
+	}
+
+	publishRoutes(routes, m, sum)
+	return true, nil
+}
+
+// publishRoutes makes routes the routes in use and returns their table.
+// Callers must hold reloadMutex.
+func publishRoutes(routes map[string]*route, m *matcher, sum [sha256.Size]byte) *routesTable {
+	table := &routesTable{routes: routes, matcher: m, version: 1, checksum: hex.EncodeToString(sum[:]), loadedAt: time.Now().UTC()}
+	if prev := currentRoutes.Load(); prev != nil {
+		table.version = prev.version + 1
+	}
+	currentRoutes.Store(table)
+	status.Version, status.Routes, status.LastSuccess = table.version, len(routes), table.loadedAt
+	status.Checksum = table.checksum
+
+	// just displaying to check the content
+	for path, rt := range routes {
+		log.Println("route", path, "url:", rt.Target, "status:", rt.Status)
+	}
+	log.Printf("Current Number Of Routes Is : %d - Version : %d\n\n", len(routes), table.version)
+	return table
+}
+
+// recordFailure records a failed reload into the status. Callers must hold reloadMutex.
+func recordFailure(err error) {
+	now := time.Now().UTC()
+	status.LastError, status.LastErrorAt = err.Error(), &now
+}
+
+// currentStatus returns a copy of the reload status.
+func currentStatus() reloadStatus {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	return status
+}
+
+// lookupRoute returns the settings of the route of path in the routes in
+// use, if it is currently served, and the target to redirect to.
+func lookupRoute(path string) (*route, string, bool) {
+	table := currentRoutes.Load()
+	if table == nil {
+		return nil, "", false
+	}
+	return table.matcher.match(path, time.Now())
+}
@@ -0,0 +1,181 @@
+package main
+
+// This file contains the schema of the routes file. The versioned format holds
+// for each route its target, redirect status code, enabled flag, activity window,
+// notes and owner. The original flat format mapping each route to its target is
+// still accepted and its routes get the default settings.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// routesSchemaVersion is the version of the routes file format. The flat
+// format has no version field and stands for version 1.
+const routesSchemaVersion = 2
+
+// defaultStatus is the redirect status code of a route which sets none.
+const defaultStatus = http.StatusMovedPermanently
+
+// route holds a dynamic route settings.
+type route struct {
+	Target string `json:"target"`
+	// Status is the redirect status code: 301, 302, 307 or 308.
+	Status int `json:"status,omitempty"`
+	// Enabled defaults to true when not set.
+	Enabled *bool `json:"enabled,omitempty"`
+	// NotBefore and ExpiresAt bound the period the route is served, if set.
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Notes     string     `json:"notes,omitempty"`
+	Owner     string     `json:"owner,omitempty"`
+	// Match is how the route pattern is matched: exact by default, prefix,
+	// glob or regex.
+	Match string `json:"match,omitempty"`
+	// Query is the policy applied to the query of the request: drop
+	// by default, pass or merge.
+	Query string `json:"query,omitempty"`
+
+	// pattern is the key of the route, re its compiled form and
+	// literal the beginning of every path it matches.
+	pattern string
+	re      *regexp.Regexp
+	literal string
+}
+
+// routesFile is the versioned format of the routes file.
+type routesFile struct {
+	Version int               `json:"version"`
+	Routes  map[string]*route `json:"routes"`
+}
+
+// active reports whether the route is served at the given time.
+func (rt *route) active(now time.Time) bool {
+	if rt.Enabled != nil && !*rt.Enabled {
+		return false
+	}
+	if rt.NotBefore != nil && now.Before(*rt.NotBefore) {
+		return false
+	}
+	return rt.ExpiresAt == nil || now.Before(*rt.ExpiresAt)
+}
+
+// validateTarget checks that target is an absolute http(s) url or a path
+// on this server.
+func validateTarget(target string) error {
+	if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid target: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("target %q must be an http(s) url or a path", target)
+	}
+	return nil
+}
+
+// reservedPrefix starts the paths of the built-in endpoints like /_status,
+// which are served before the dynamic routes.
+const reservedPrefix = "/_"
+
+// validateRoute checks the route settings and sets the default status code.
+func validateRoute(path string, rt *route) error {
+	if rt == nil {
+		return fmt.Errorf("route %q has no settings", path)
+	}
+	if err := compileRoute(path, rt); err != nil {
+		return fmt.Errorf("route %q: %w", path, err)
+	}
+	if rt.Match != matchRegex && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("route %q must start with /", path)
+	}
+	if rt.Match != matchRegex && strings.HasPrefix(path, reservedPrefix) {
+		return fmt.Errorf("route %q is under %s which is reserved for the built-in endpoints", path, reservedPrefix)
+	}
+	if err := validateTarget(rt.Target); err != nil {
+		return fmt.Errorf("route %q: %w", path, err)
+	}
+	switch rt.Status {
+	case 0:
+		rt.Status = defaultStatus
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("route %q has unsupported status %d - expected 301, 302, 307 or 308", path, rt.Status)
+	}
+	policy, err := validateQueryPolicy(rt.Query)
+	if err != nil {
+		return fmt.Errorf("route %q: %w", path, err)
+	}
+	rt.Query = policy
+	if rt.NotBefore != nil && rt.ExpiresAt != nil && !rt.NotBefore.Before(*rt.ExpiresAt) {
+		return fmt.Errorf("route %q expires before it starts", path)
+	}
+	return nil
+}
+
+// decodeRoutes decodes the routes of either format.
+func decodeRoutes(content []byte) (map[string]*route, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+	if _, versioned := fields["version"]; !versioned {
+		flat := make(map[string]string)
+		if err := json.Unmarshal(content, &flat); err != nil {
+			return nil, fmt.Errorf("flat format expects a target url per route: %w", err)
+		}
+		routes := make(map[string]*route, len(flat))
+		for path, target := range flat {
+			routes[path] = &route{Target: target}
+		}
+		return routes, nil
+	}
+
+	var file routesFile
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, err
+	}
+	if file.Version != routesSchemaVersion {
+		return nil, fmt.Errorf("unsupported routes file version %d - expected %d", file.Version, routesSchemaVersion)
+	}
+	if file.Routes == nil {
+		file.Routes = make(map[string]*route)
+	}
+	return file.Routes, nil
+}
+
+// parseRoutes builds a new table of routes from the json content and checks
+// every route. All invalid routes are reported together.
+func parseRoutes(content []byte) (map[string]*route, error) {
+	routes, err := decodeRoutes(content)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(routes))
+	for path := range routes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var errs []error
+	for _, path := range paths {
+		if err := validateRoute(path, routes[path]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return routes, nil
+}
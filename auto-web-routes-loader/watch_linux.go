@@ -0,0 +1,130 @@
+//go:build linux
+
+package main
+
+// This file contains the inotify based watching of the routes file on linux.
+// The directory holding the file is watched rather than the file itself so that
+// editors saving through a temporary file renamed over the original are noticed,
+// and the parent directory of each symbolic link of the path is watched as well
+// so that swapping a link to another directory is noticed.
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask is the set of events which may change the routes file.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// watchedEntries returns the directories to watch for the file at path
+// and the names of their entries whose changes matter.
+func watchedEntries(path string) (map[string]bool, map[string]bool, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	dirs := map[string]bool{filepath.Dir(abs): true}
+	names := map[string]bool{filepath.Base(abs): true}
+	for p := filepath.Dir(abs); p != filepath.Dir(p); p = filepath.Dir(p) {
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			dirs[filepath.Dir(p)] = true
+			names[filepath.Base(p)] = true
+		}
+	}
+	return dirs, names, nil
+}
+
+// inotifyWatcher holds the inotify instance and its current watches.
+type inotifyWatcher struct {
+	fd    int
+	f     *os.File
+	path  string
+	wds   map[int]bool
+	names map[string]bool
+}
+
+// rewatch replaces the watches by the ones of the current resolution of the
+// path, which changes when a symbolic link was swapped.
+func (iw *inotifyWatcher) rewatch() error {
+	for wd := range iw.wds {
+		syscall.InotifyRmWatch(iw.fd, uint32(wd))
+	}
+	dirs, names, err := watchedEntries(iw.path)
+	if err != nil {
+		return err
+	}
+	iw.wds, iw.names = make(map[int]bool), names
+	for dir := range dirs {
+		wd, err := syscall.InotifyAddWatch(iw.fd, dir, inotifyMask)
+		if err != nil {
+			return err
+		}
+		iw.wds[wd] = true
+	}
+	return nil
+}
+
+// relevant reports whether the events of buf concern the watched entries.
+func (iw *inotifyWatcher) relevant(buf []byte) bool {
+	found := false
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+		name := string(nameBytes[:clen(nameBytes)])
+		offset += syscall.SizeofInotifyEvent + int(event.Len)
+		switch {
+		case event.Mask&syscall.IN_IGNORED != 0:
+			// a removed watch - caused by rewatch or by a deleted directory.
+		case event.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0, iw.names[name]:
+			found = true
+		}
+	}
+	return found
+}
+
+// clen returns the length of the NUL terminated string held by b.
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+// watchRoutesFile calls notify each time the file at path may have changed,
+// until the returned stop function is called.
+func watchRoutesFile(path string, notify func()) (func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	// a non blocking descriptor is handled by the runtime poller so that
+	// closing the file unblocks the pending read.
+	iw := &inotifyWatcher{fd: fd, f: os.NewFile(uintptr(fd), "inotify"), path: path}
+	if err := iw.rewatch(); err != nil {
+		iw.f.Close()
+		return nil, err
+	}
+
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := iw.f.Read(buf)
+			if err != nil {
+				return
+			}
+			if !iw.relevant(buf[:n]) {
+				continue
+			}
+			// the directories may have been replaced or re-linked.
+			iw.rewatch()
+			notify()
+		}
+	}()
+	return func() { iw.f.Close() }, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// This file contains the fallback of the routes file watching on the systems
+// without inotify support. The routes file is then only polled.
+
+import "errors"
+
+// watchRoutesFile reports that event based watching is not supported.
+func watchRoutesFile(path string, notify func()) (func(), error) {
+	return nil, errors.New("routes file watching is only supported on linux")
+}
@@ -0,0 +1,148 @@
+package main
+
+// This file contains the classification of addresses into well-known categories
+// and the filtering of records based on their category.
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// addresses categories.
+const (
+	categoryPublic        = "public"
+	categoryLoopback      = "loopback"
+	categoryPrivate       = "private"
+	categoryLinkLocal     = "link-local"
+	categoryMulticast     = "multicast"
+	categoryDocumentation = "documentation"
+	categoryCGNAT         = "cgnat"
+	categoryBogon         = "bogon"
+	// categoryMixed is used for a block which spans several categories.
+	categoryMixed = "mixed"
+)
+
+// categories lists the names accepted by the -include and -exclude flags.
+var categories = []string{
+	categoryPublic, categoryLoopback, categoryPrivate, categoryLinkLocal, categoryMulticast,
+	categoryDocumentation, categoryCGNAT, categoryBogon, categoryMixed,
+}
+
+// categoryPrefix associates a special-purpose block to its category.
+type categoryPrefix struct {
+	prefix   netip.Prefix
+	category string
+}
+
+// categoryPrefixes lists the special-purpose blocks of both families. Bogon
+// gathers what remains of the reserved space (RFC 6890 and RFC 5156) once the
+// other categories are taken out.
+var categoryPrefixes = []categoryPrefix{
+	{netip.MustParsePrefix("127.0.0.0/8"), categoryLoopback},
+	{netip.MustParsePrefix("::1/128"), categoryLoopback},
+	{netip.MustParsePrefix("10.0.0.0/8"), categoryPrivate},
+	{netip.MustParsePrefix("172.16.0.0/12"), categoryPrivate},
+	{netip.MustParsePrefix("192.168.0.0/16"), categoryPrivate},
+	{netip.MustParsePrefix("fc00::/7"), categoryPrivate},
+	{netip.MustParsePrefix("169.254.0.0/16"), categoryLinkLocal},
+	{netip.MustParsePrefix("fe80::/10"), categoryLinkLocal},
+	{netip.MustParsePrefix("224.0.0.0/4"), categoryMulticast},
+	{netip.MustParsePrefix("ff00::/8"), categoryMulticast},
+	{netip.MustParsePrefix("192.0.2.0/24"), categoryDocumentation},
+	{netip.MustParsePrefix("198.51.100.0/24"), categoryDocumentation},
+	{netip.MustParsePrefix("203.0.113.0/24"), categoryDocumentation},
+	{netip.MustParsePrefix("2001:db8::/32"), categoryDocumentation},
+	{netip.MustParsePrefix("3fff::/20"), categoryDocumentation},
+	{netip.MustParsePrefix("100.64.0.0/10"), categoryCGNAT},
+	{netip.MustParsePrefix("0.0.0.0/8"), categoryBogon},
+	{netip.MustParsePrefix("192.0.0.0/24"), categoryBogon},
+	{netip.MustParsePrefix("198.18.0.0/15"), categoryBogon},
+	{netip.MustParsePrefix("240.0.0.0/4"), categoryBogon},
+	{netip.MustParsePrefix("::/128"), categoryBogon},
+	{netip.MustParsePrefix("100::/64"), categoryBogon},
+	{netip.MustParsePrefix("2001::/23"), categoryBogon},
+	{netip.MustParsePrefix("3ffe::/16"), categoryBogon},
+	{netip.MustParsePrefix("5f00::/8"), categoryBogon},
+}
+
+// classify returns the category of p. IPv4-mapped IPv6 addresses are classified
+// as their IPv4 counterpart. A block which contains special-purpose addresses
+// without being fully inside one category is classified as mixed.
+func classify(p netip.Prefix) string {
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	category := categoryPublic
+	for _, cp := range categoryPrefixes {
+		if !cp.prefix.Overlaps(p) {
+			continue
+		}
+		if cp.prefix.Bits() <= p.Bits() {
+			return cp.category
+		}
+		category = categoryMixed
+	}
+	return category
+}
+
+// categoryFilter decides which records to keep based on their category.
+type categoryFilter struct {
+	include map[string]bool
+	exclude map[string]bool
+}
+
+// parseCategories parses a comma separated list of categories.
+func parseCategories(list string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		valid := false
+		for _, c := range categories {
+			valid = valid || c == name
+		}
+		if !valid {
+			return nil, fmt.Errorf("unknown category %q - expected one of %s", name, strings.Join(categories, ", "))
+		}
+		set[name] = true
+	}
+	return set, nil
+}
+
+// newCategoryFilter builds a filter from the -include and -exclude lists.
+func newCategoryFilter(include, exclude string) (categoryFilter, error) {
+	var f categoryFilter
+	var err error
+	if f.include, err = parseCategories(include); err != nil {
+		return f, err
+	}
+	f.exclude, err = parseCategories(exclude)
+	return f, err
+}
+
+// keep reports whether a record of the given category passes the filter.
+func (f categoryFilter) keep(category string) bool {
+	if len(f.include) > 0 && !f.include[category] {
+		return false
+	}
+	return !f.exclude[category]
+}
+
+// classifyRecords sets the category of each record and only
+// forwards those which pass the filter.
+func classifyRecords(records <-chan record, f categoryFilter) <-chan record {
+	out := make(chan record, cap(records))
+	go func() {
+		defer close(out)
+		for r := range records {
+			r.category = classify(r.prefix)
+			if f.keep(r.category) {
+				out <- r
+			}
+		}
+	}()
+	return out
+}
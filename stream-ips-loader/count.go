@@ -0,0 +1,158 @@
+package main
+
+// This file contains the counting mode which tallies how many times each address
+// and each aggregated prefix (/24 and /64 by default) shows up, prints the top
+// entries and can write the full histogram as CSV or JSON.
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// counter tallies the occurrences of addresses and of their aggregated prefix.
+type counter struct {
+	v4Bits, v6Bits int
+	total          int
+	addrs          map[netip.Prefix]int
+	prefixes       map[netip.Prefix]int
+}
+
+// newCounter returns a counter aggregating IPv4 addresses by v4Bits
+// prefixes and IPv6 addresses by v6Bits prefixes.
+func newCounter(v4Bits, v6Bits int) (*counter, error) {
+	if v4Bits < 0 || v4Bits > 32 || v6Bits < 0 || v6Bits > 128 {
+		return nil, fmt.Errorf("invalid aggregation lengths /%d and /%d", v4Bits, v6Bits)
+	}
+	return &counter{
+		v4Bits:   v4Bits,
+		v6Bits:   v6Bits,
+		addrs:    make(map[netip.Prefix]int),
+		prefixes: make(map[netip.Prefix]int),
+	}, nil
+}
+
+// add counts one occurrence of p. A block is only counted under prefixes,
+// as its own prefix when larger than the aggregation length.
+func (c *counter) add(p netip.Prefix) {
+	c.total++
+	if p.IsSingleIP() {
+		c.addrs[p]++
+	}
+	bits := c.v6Bits
+	if p.Addr().Is4() {
+		bits = c.v4Bits
+	}
+	if p.Bits() > bits {
+		p = netip.PrefixFrom(p.Addr(), bits).Masked()
+	}
+	c.prefixes[p]++
+}
+
+// countEntry is a single line of a histogram.
+type countEntry struct {
+	Key     string  `json:"key"`
+	Count   int     `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+// sortedCounts returns the entries of counts ordered by decreasing count,
+// then by address so the output is stable.
+func (c *counter) sortedCounts(counts map[netip.Prefix]int) []countEntry {
+	keys := make([]netip.Prefix, 0, len(counts))
+	for p := range counts {
+		keys = append(keys, p)
+	}
+	slices.SortFunc(keys, func(a, b netip.Prefix) int {
+		if n := cmp.Compare(counts[b], counts[a]); n != 0 {
+			return n
+		}
+		if n := a.Addr().Compare(b.Addr()); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.Bits(), b.Bits())
+	})
+	entries := make([]countEntry, 0, len(keys))
+	for _, p := range keys {
+		entries = append(entries, countEntry{Key: formatPrefix(p), Count: counts[p], Percent: c.percent(counts[p])})
+	}
+	return entries
+}
+
+// percent returns n as a percentage of all counted entries.
+func (c *counter) percent(n int) float64 {
+	if c.total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(c.total)
+}
+
+// writeTop writes a table of the n most frequent entries.
+func writeTop(w io.Writer, title string, entries []countEntry, n int) {
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	fmt.Fprintf(w, "%s\n%-6s %12s %9s  %s\n", title, "RANK", "COUNT", "PERCENT", "ENTRY")
+	for i, e := range entries {
+		fmt.Fprintf(w, "%-6d %12d %8.2f%%  %s\n", i+1, e.Count, e.Percent, e.Key)
+	}
+}
+
+// writeReport writes the top n addresses and aggregated prefixes.
+func (c *counter) writeReport(w io.Writer, n int) {
+	fmt.Fprintf(w, "%d entries - %d distinct addresses - %d distinct prefixes\n\n", c.total, len(c.addrs), len(c.prefixes))
+	writeTop(w, fmt.Sprintf("TOP %d ADDRESSES", n), c.sortedCounts(c.addrs), n)
+	fmt.Fprintln(w)
+	writeTop(w, fmt.Sprintf("TOP %d PREFIXES (/%d and /%d)", n, c.v4Bits, c.v6Bits), c.sortedCounts(c.prefixes), n)
+}
+
+// histogramFormat returns the format of the histogram file: the given
+// one, otherwise json for a .json file name and csv for anything else.
+func histogramFormat(format, path string) (string, error) {
+	if format == "" {
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			return "json", nil
+		}
+		return "csv", nil
+	}
+	if format != "csv" && format != "json" {
+		return "", fmt.Errorf("unknown histogram format %q - expected csv or json", format)
+	}
+	return format, nil
+}
+
+// writeHistogram writes every counted address and prefix in the given format.
+func (c *counter) writeHistogram(w io.Writer, format string) error {
+	addrs, prefixes := c.sortedCounts(c.addrs), c.sortedCounts(c.prefixes)
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Total     int          `json:"total"`
+			V4Bits    int          `json:"v4_prefix_length"`
+			V6Bits    int          `json:"v6_prefix_length"`
+			Addresses []countEntry `json:"addresses"`
+			Prefixes  []countEntry `json:"prefixes"`
+		}{c.total, c.v4Bits, c.v6Bits, addrs, prefixes})
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "key", "count", "percent"})
+	for _, kind := range []struct {
+		name    string
+		entries []countEntry
+	}{{"address", addrs}, {"prefix", prefixes}} {
+		for _, e := range kind.entries {
+			cw.Write([]string{kind.name, e.Key, strconv.Itoa(e.Count), strconv.FormatFloat(e.Percent, 'f', 4, 64)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,115 @@
+package main
+
+// This file contains the transparent decompression of the sources. The format
+// is detected from the magic bytes of the content, never from the file name, so
+// compressed data piped to the program is handled as well. Gzip and bzip2 are
+// decoded natively while zstd and xz are streamed through their own commands.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// compression describes a supported compression format.
+type compression struct {
+	name  string
+	magic []byte
+	// command is the external decompressor used when there is no native one.
+	command []string
+}
+
+// compressions lists the detected formats.
+var compressions = []compression{
+	{name: "gzip", magic: []byte{0x1f, 0x8b}},
+	{name: "bzip2", magic: []byte("BZh")},
+	{name: "zstd", magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, command: []string{"zstd", "-dcq"}},
+	{name: "xz", magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, command: []string{"xz", "-dcq"}},
+}
+
+// detectCompression returns the compression format of the content which
+// starts with head, or nil for uncompressed content.
+func detectCompression(head []byte) *compression {
+	for i := range compressions {
+		if bytes.HasPrefix(head, compressions[i].magic) {
+			return &compressions[i]
+		}
+	}
+	return nil
+}
+
+// commandReader streams the output of an external decompressor.
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+// Close waits for the decompressor and reports its failure, if any.
+func (cr *commandReader) Close() error {
+	cr.ReadCloser.Close()
+	if err := cr.cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(cr.stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", cr.cmd.Args[0], err, msg)
+		}
+		return fmt.Errorf("%s: %w", cr.cmd.Args[0], err)
+	}
+	return nil
+}
+
+// decompress returns a reader of the decompressed content of r along with the
+// detected format name, empty for uncompressed content which is returned as is.
+// The returned reader must be closed to release the decompressor.
+func decompress(r io.Reader) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(8)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, "", err
+	}
+	c := detectCompression(head)
+	if c == nil {
+		return io.NopCloser(br), "", nil
+	}
+
+	switch {
+	case c.name == "gzip":
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, c.name, err
+		}
+		return zr, c.name, nil
+	case c.name == "bzip2":
+		return io.NopCloser(bzip2.NewReader(br)), c.name, nil
+	}
+
+	cmd := exec.Command(c.command[0], c.command[1:]...)
+	cmd.Stdin = br
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, c.name, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, c.name, fmt.Errorf("%s content requires the %s command: %w", c.name, c.command[0], err)
+	}
+	return &commandReader{ReadCloser: stdout, cmd: cmd, stderr: stderr}, c.name, nil
+}
+
+// parseCompressed decompresses r when needed then parses its lines until
+// ctx is done.
+func parseCompressed(ctx context.Context, r io.Reader, in input, opts options, diag *diagnostics, out chan<- record) error {
+	dr, _, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	err = parseLines(ctx, dr, in, opts, diag, out)
+	return errors.Join(err, dr.Close())
+}
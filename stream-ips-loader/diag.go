@@ -0,0 +1,156 @@
+package main
+
+// This file contains the diagnostics of the loading: every rejected entry and
+// unreadable source is reported with its location, and a summary of counts per
+// source is written at the end. The strict mode turns any rejection into a failure.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// maxReportedText is the maximum length of a rejected line into the report.
+const maxReportedText = 128
+
+// sourceCounts holds the loading counters of a single source.
+type sourceCounts struct {
+	accepted int
+	rejected int
+	ignored  int
+	flagged  int
+	err      error
+}
+
+// diagnostics records the rejected entries and the counts per source.
+// It is safe for concurrent use by the sources readers.
+type diagnostics struct {
+	mu sync.Mutex
+	// w receives each rejection as it happens. It can be nil.
+	w        io.Writer
+	counts   map[string]*sourceCounts
+	sources  []string
+	rejected int
+	flagged  int
+}
+
+// newDiagnostics returns diagnostics reporting rejections to w, if not nil.
+func newDiagnostics(w io.Writer) *diagnostics {
+	return &diagnostics{w: w, counts: make(map[string]*sourceCounts)}
+}
+
+// source returns the counters of source. Callers must hold the lock.
+func (d *diagnostics) source(source string) *sourceCounts {
+	c, found := d.counts[source]
+	if !found {
+		c = &sourceCounts{}
+		d.counts[source] = c
+		d.sources = append(d.sources, source)
+	}
+	return c
+}
+
+// accept counts a valid line of source.
+func (d *diagnostics) accept(source string) {
+	d.mu.Lock()
+	d.source(source).accepted++
+	d.mu.Unlock()
+}
+
+// ignore counts an empty or comment line of source.
+func (d *diagnostics) ignore(source string) {
+	d.mu.Lock()
+	d.source(source).ignored++
+	d.mu.Unlock()
+}
+
+// reject counts and reports an invalid line of source.
+func (d *diagnostics) reject(source string, line int, text string, reason error) {
+	if len(text) > maxReportedText {
+		text = text[:maxReportedText] + "..."
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.source(source).rejected++
+	d.rejected++
+	if d.w != nil {
+		fmt.Fprintf(d.w, "%s:%d: rejected %q: %v\n", source, line, text, reason)
+	}
+}
+
+// flag counts and reports a line of source accepted with a warning.
+func (d *diagnostics) flag(source string, line int, text string, warning string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.source(source).flagged++
+	d.flagged++
+	if d.w != nil {
+		fmt.Fprintf(d.w, "%s:%d: flagged %q: %s\n", source, line, text, warning)
+	}
+}
+
+// fail reports a source which could not be read, fully or partially.
+func (d *diagnostics) fail(source string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.source(source).err = err
+	d.rejected++
+	if d.w != nil {
+		fmt.Fprintf(d.w, "%s: unreadable source: %v\n", source, err)
+	}
+}
+
+// failures returns the number of rejected lines and unreadable sources.
+func (d *diagnostics) failures() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rejected
+}
+
+// strictFailure returns the error of the strict mode when any entry was
+// rejected or flagged or any source unreadable, nil otherwise.
+func (d *diagnostics) strictFailure() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.rejected+d.flagged == 0 {
+		return nil
+	}
+	return fmt.Errorf("strict mode - %d entries rejected or sources unreadable - %d entries flagged", d.rejected, d.flagged)
+}
+
+// sourceErrors returns the errors of the unreadable sources joined, or nil.
+func (d *diagnostics) sourceErrors() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs []error
+	for _, source := range d.sources {
+		if err := d.counts[source].err; err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// summary writes the counts of each source, in the order they were first seen.
+func (d *diagnostics) summary(w io.Writer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintf(w, "%-40s %10s %10s %10s %10s  %s\n", "SOURCE", "ACCEPTED", "REJECTED", "IGNORED", "FLAGGED", "ERROR")
+	var total sourceCounts
+	for _, source := range d.sources {
+		c := d.counts[source]
+		errMsg := ""
+		if c.err != nil {
+			errMsg = c.err.Error()
+		}
+		line := fmt.Sprintf("%-40s %10d %10d %10d %10d  %s", source, c.accepted, c.rejected, c.ignored, c.flagged, errMsg)
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+		total.accepted += c.accepted
+		total.rejected += c.rejected
+		total.ignored += c.ignored
+		total.flagged += c.flagged
+	}
+	fmt.Fprintf(w, "%-40s %10d %10d %10d %10d\n", "TOTAL", total.accepted, total.rejected, total.ignored, total.flagged)
+}
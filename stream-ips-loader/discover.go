@@ -0,0 +1,273 @@
+package main
+
+// This file contains the discovery of the files to read from the arguments: a
+// directory is listed, optionally recursively, a glob pattern like logs/**/*.log
+// is expanded without relying on the shell, and an @listfile argument holds more
+// arguments, one per line. Symbolic links to directories are followed once so a
+// link loop is detected and reported instead of being walked forever.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errSymlinkLoop reports a directory reached again through a symbolic link.
+var errSymlinkLoop = errors.New("symbolic link loop detected")
+
+// discovery expands the inputs into the files to read.
+type discovery struct {
+	recursive bool
+	// include and exclude are glob patterns matched against the files names.
+	include, exclude []string
+	diag             *diagnostics
+	// lists holds the list files being read to detect lists including themselves.
+	lists map[string]bool
+	files []input
+}
+
+// splitPatterns splits a comma separated list of glob patterns.
+func splitPatterns(list string) []string {
+	var patterns []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// checkPatterns reports the first malformed pattern of the list.
+func checkPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid file pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// discoverInputs returns the files to read for the inputs. Remote sources and
+// plain files are kept as is and discovered files keep the name of the
+// argument they come from. Failures are reported to diag.
+func discoverInputs(inputs []input, opts options, diag *diagnostics) []input {
+	d := &discovery{
+		recursive: opts.recursive,
+		include:   splitPatterns(opts.includeFiles),
+		exclude:   splitPatterns(opts.excludeFiles),
+		diag:      diag,
+		lists:     make(map[string]bool),
+	}
+	for _, in := range inputs {
+		d.expand(in)
+	}
+	return d.files
+}
+
+// hasMeta reports whether p contains glob metacharacters.
+func hasMeta(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// keep reports whether a discovered file passes the include and exclude patterns.
+func (d *discovery) keep(file string) bool {
+	name := filepath.Base(file)
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(d.include) > 0 && !matches(d.include) {
+		return false
+	}
+	return !matches(d.exclude)
+}
+
+// expand adds the files designated by a single input.
+func (d *discovery) expand(in input) {
+	switch {
+	case isRemote(in.path):
+		d.files = append(d.files, in)
+	case strings.HasPrefix(in.path, "@"):
+		d.readList(in)
+	case hasMeta(in.path):
+		d.glob(in)
+	default:
+		fi, err := os.Stat(in.path)
+		if err != nil || !fi.IsDir() {
+			// errors are reported when the file is opened.
+			d.files = append(d.files, in)
+			return
+		}
+		maxDepth := 1
+		if d.recursive {
+			maxDepth = -1
+		}
+		d.walk(in.path, maxDepth, map[string]bool{}, func(file string, _ []string) {
+			if d.keep(file) {
+				d.files = append(d.files, input{name: in.name, path: file})
+			}
+		})
+	}
+}
+
+// readList expands each line of the @listfile as an input. Relative paths are
+// resolved from the directory of the list file. Empty lines and # comments
+// are ignored.
+func (d *discovery) readList(in input) {
+	listPath := strings.TrimPrefix(in.path, "@")
+	abs, err := filepath.Abs(listPath)
+	if err != nil {
+		d.diag.fail(listPath, err)
+		return
+	}
+	if d.lists[abs] {
+		d.diag.fail(listPath, errors.New("list file includes itself"))
+		return
+	}
+	f, err := os.Open(listPath)
+	if err != nil {
+		d.diag.fail(listPath, err)
+		return
+	}
+	defer f.Close()
+
+	d.lists[abs] = true
+	defer delete(d.lists, abs)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := strings.TrimSpace(scanner.Text())
+		if isIgnored(entry) {
+			continue
+		}
+		if !isRemote(entry) {
+			ref := strings.TrimPrefix(entry, "@")
+			if !filepath.IsAbs(ref) {
+				ref = filepath.Join(filepath.Dir(listPath), ref)
+			}
+			if strings.HasPrefix(entry, "@") {
+				ref = "@" + ref
+			}
+			entry = ref
+		}
+		d.expand(input{name: in.name, path: entry})
+	}
+	if err := scanner.Err(); err != nil {
+		d.diag.fail(listPath, err)
+	}
+}
+
+// glob adds the files matching the pattern of in. A ** segment matches any
+// number of directories, other segments follow path.Match.
+func (d *discovery) glob(in input) {
+	segments := strings.Split(filepath.ToSlash(in.path), "/")
+	// the walk starts from the longest leading part without metacharacters.
+	n := 0
+	for n < len(segments)-1 && !hasMeta(segments[n]) {
+		n++
+	}
+	root := strings.Join(segments[:n], "/")
+	switch {
+	case root == "" && n > 0:
+		root = "/"
+	case root == "":
+		root = "."
+	}
+	pattern := segments[n:]
+	for _, s := range pattern {
+		if _, err := path.Match(s, ""); err != nil {
+			d.diag.fail(in.path, fmt.Errorf("invalid pattern: %w", err))
+			return
+		}
+	}
+
+	maxDepth := len(pattern)
+	for _, s := range pattern {
+		if s == "**" {
+			maxDepth = -1
+		}
+	}
+	found := false
+	d.walk(filepath.FromSlash(root), maxDepth, map[string]bool{}, func(file string, rel []string) {
+		if matchSegments(pattern, rel) && d.keep(file) {
+			found = true
+			d.files = append(d.files, input{name: in.name, path: file})
+		}
+	})
+	if !found {
+		d.diag.fail(in.path, errors.New("no file matches the pattern"))
+	}
+}
+
+// matchSegments reports whether the path segments match the pattern segments.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segments[0])
+	return ok && matchSegments(pattern[1:], segments[1:])
+}
+
+// walk calls fn with each regular file under dir and its path segments
+// relative to dir, going at most maxDepth levels down (no limit if negative).
+// Symbolic links are followed and visited holds the real paths of the
+// directories being walked so a link loop is reported once.
+func (d *discovery) walk(dir string, maxDepth int, visited map[string]bool, fn func(file string, rel []string)) {
+	d.walkDir(dir, nil, maxDepth, visited, fn)
+}
+
+func (d *discovery) walkDir(dir string, rel []string, maxDepth int, visited map[string]bool, fn func(file string, rel []string)) {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		d.diag.fail(dir, err)
+		return
+	}
+	if visited[real] {
+		d.diag.fail(dir, fmt.Errorf("%w: %s already walked", errSymlinkLoop, real))
+		return
+	}
+	visited[real] = true
+	defer delete(visited, real)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		d.diag.fail(dir, err)
+		return
+	}
+	for _, e := range entries {
+		file := filepath.Join(dir, e.Name())
+		fi, err := os.Stat(file)
+		if err != nil {
+			d.diag.fail(file, err)
+			continue
+		}
+		segments := append(rel[:len(rel):len(rel)], e.Name())
+		if !fi.IsDir() {
+			if fi.Mode().IsRegular() {
+				fn(file, segments)
+			}
+			continue
+		}
+		if maxDepth < 0 || len(segments) < maxDepth {
+			d.walkDir(file, segments, maxDepth, visited, fn)
+		}
+	}
+}
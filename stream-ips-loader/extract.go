@@ -0,0 +1,129 @@
+package main
+
+// This file contains the extraction of addresses embedded into free-form text
+// such as access logs, firewall logs or URLs.
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// maxAddrLen is longer than the longest textual address without zone.
+const maxAddrLen = 64
+
+// match is an address found into a text and its byte offset.
+type match struct {
+	addr   netip.Addr
+	offset int
+	// text is the address as written into the text.
+	text string
+	// leadingZeros is set when addr was only read by dropping leading
+	// zeros of its octets, like 010.0.0.1.
+	leadingZeros bool
+}
+
+// isAddrChar reports whether c can be part of a textual address.
+func isAddrChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' || c == '.' || c == ':'
+}
+
+// isHexDigit reports whether c is an hexadecimal digit.
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// isWordChar reports whether c belongs to a word so that an address cannot
+// start right after it.
+func isWordChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+// isZoneChar reports whether c can be part of an IPv6 zone identifier.
+func isZoneChar(c byte) bool {
+	return isWordChar(c) || c == '-' || c == '.'
+}
+
+// extractAddrs returns all IPv4 and IPv6 addresses found into text along with
+// their offset. It handles addresses followed by a port (10.1.2.3:53), inside
+// brackets ([2001:db8::1]:8080) and with a zone (fe80::1%eth0). An address
+// must not be glued to a word, so v1.2.3.4 or 1.2.3.4.5 are not matched.
+// Octets with leading zeros like 010.0.0.1 are matched and marked as such.
+func extractAddrs(text string) []match {
+	var matches []match
+	for i := 0; i < len(text); {
+		if !isAddrChar(text[i]) || (i > 0 && (isWordChar(text[i-1]) || text[i-1] == '.' || text[i-1] == ':')) {
+			i++
+			continue
+		}
+		// maximal run of characters which could be part of an address.
+		end := i
+		for end < len(text) && isAddrChar(text[end]) {
+			end++
+		}
+		if end-i > maxAddrLen || (end < len(text) && isWordChar(text[end])) {
+			i = end
+			continue
+		}
+		m, size := longestAddr(text, i, end)
+		if size == 0 {
+			i = end
+			continue
+		}
+		matches = append(matches, m)
+		i += size
+	}
+	return matches
+}
+
+// longestAddr returns the longest address found at the start of the run
+// text[start:end] and its size into text, zone included. The address must
+// be followed by the end of the run, by a ':' (port) or by a '.' ending
+// a sentence. It returns a zero size when nothing is found.
+func longestAddr(text string, start, end int) (match, int) {
+	for stop := end; stop > start; stop-- {
+		if stop < end {
+			next := text[stop]
+			if next != ':' && next != '.' {
+				continue
+			}
+			if next == '.' && stop+1 < end && isHexDigit(text[stop+1]) {
+				continue
+			}
+		}
+		candidate := text[start:stop]
+		if !strings.ContainsAny(candidate, "0123456789abcdefABCDEF") {
+			continue
+		}
+		addr, err := netip.ParseAddr(candidate)
+		leadingZeros := false
+		if err != nil {
+			fixed, changed := stripLeadingZeros(candidate)
+			if !changed {
+				continue
+			}
+			if addr, err = netip.ParseAddr(fixed); err != nil {
+				continue
+			}
+			leadingZeros = true
+		}
+		size := stop - start
+		// a zone can follow an IPv6 address which ends the run.
+		if addr.Is6() && stop == end && end < len(text) && text[end] == '%' {
+			zoneEnd := end + 1
+			for zoneEnd < len(text) && isZoneChar(text[zoneEnd]) {
+				zoneEnd++
+			}
+			zone := text[end+1 : zoneEnd]
+			// URLs percent-encode the zone separator as %25.
+			if start > 0 && text[start-1] == '[' && strings.HasPrefix(zone, "25") && len(zone) > 2 {
+				zone = zone[2:]
+			}
+			if zone != "" {
+				addr = addr.WithZone(zone)
+				size = zoneEnd - start
+			}
+		}
+		return match{addr: addr, offset: start, text: text[start : start+size], leadingZeros: leadingZeros}, size
+	}
+	return match{}, 0
+}
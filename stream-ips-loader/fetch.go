@@ -0,0 +1,202 @@
+package main
+
+// This file contains the download of remote http(s) sources. Each feed is kept
+// into a local cache directory along with its validators so later downloads are
+// conditional requests, and the cached copy is used when a download fails.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// isRemote reports whether path is an http(s) URL.
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// cacheMeta holds the validators of a cached feed.
+type cacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// fetcher downloads remote sources into a local cache directory.
+type fetcher struct {
+	client   *http.Client
+	cacheDir string
+	// retries is the number of attempts after the first failed one.
+	retries int
+	// backoff is the delay before the first retry. It doubles at each retry.
+	backoff time.Duration
+}
+
+// newFetcher returns a fetcher configured from the options.
+func newFetcher(opts options) *fetcher {
+	return &fetcher{
+		client:   &http.Client{Timeout: opts.httpTimeout},
+		cacheDir: opts.cacheDir,
+		retries:  opts.httpRetries,
+		backoff:  time.Second,
+	}
+}
+
+// defaultCacheDir returns the cache directory used when -cache-dir is not set.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "stream-ips-loader")
+}
+
+// cachePaths returns the data and metadata files paths of url.
+func (f *fetcher) cachePaths(url string) (string, string) {
+	sum := sha256.Sum256([]byte(url))
+	base := filepath.Join(f.cacheDir, hex.EncodeToString(sum[:16]))
+	return base + ".data", base + ".json"
+}
+
+// readMeta returns the cached validators of url, if any.
+func (f *fetcher) readMeta(url string) (cacheMeta, bool) {
+	_, metaPath := f.cachePaths(url)
+	var meta cacheMeta
+	content, err := os.ReadFile(metaPath)
+	if err != nil || json.Unmarshal(content, &meta) != nil || meta.URL != url {
+		return cacheMeta{}, false
+	}
+	return meta, true
+}
+
+// errNotModified is returned by download when the cached copy is up to date.
+var errNotModified = errors.New("not modified")
+
+// statusError is an unexpected HTTP status of a feed response.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %q", e.status)
+}
+
+// retryable reports whether a failed download may succeed later: network
+// errors, 429 and 5xx responses are retried while a 401, 403 or 404 comes
+// from a wrong feed URL or credentials which the retries would not fix.
+func retryable(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.code == http.StatusTooManyRequests || se.code >= 500
+}
+
+// download does a single conditional request of url and stores a new body
+// into the cache. It returns errNotModified on a 304 response.
+func (f *fetcher) download(url string, meta cacheMeta, cached bool) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if cached {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached:
+		return errNotModified
+	case resp.StatusCode != http.StatusOK:
+		return &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+
+	dataPath, metaPath := f.cachePaths(url)
+	// the body goes to a temporary file renamed once complete so that an
+	// interrupted download never replaces a good cached copy.
+	tmp, err := os.CreateTemp(f.cacheDir, "download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), dataPath); err != nil {
+		return err
+	}
+
+	meta = cacheMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now().UTC(),
+	}
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, content, 0o644)
+}
+
+// fetch returns the content of url. The feed is downloaded when it changed
+// since the cached copy, with retries on transient failures. If every attempt fails the
+// cached copy is returned, when there is one.
+func (f *fetcher) fetch(url string) (io.ReadCloser, error) {
+	if err := os.MkdirAll(f.cacheDir, 0o755); err != nil {
+		return nil, err
+	}
+	dataPath, _ := f.cachePaths(url)
+	meta, cached := f.readMeta(url)
+	if cached {
+		if _, err := os.Stat(dataPath); err != nil {
+			cached = false
+		}
+	}
+
+	var err error
+	delay := f.backoff
+	for attempt := 0; attempt <= f.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = f.download(url, meta, cached); err == nil || errors.Is(err, errNotModified) {
+			return os.Open(dataPath)
+		}
+		if !retryable(err) {
+			break
+		}
+	}
+
+	if !cached {
+		return nil, fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	log.Printf("failed to fetch %s - using the copy cached at %s - %v\n", url, meta.FetchedAt.Format(time.RFC3339), err)
+	return os.Open(dataPath)
+}
@@ -0,0 +1,243 @@
+package main
+
+// This file contains the follow mode which watches growing files the way
+// `tail -F` does: new lines are parsed as they are appended, a rotated file
+// is reopened under its name and a truncated or rewritten file is read again
+// from its start.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// headSize is the number of first bytes of a followed file kept to detect
+// that it was rewritten in place without shrinking.
+const headSize = 256
+
+// follower tails a single file and hands its complete lines to handle.
+type follower struct {
+	in     input
+	handle func(line int, offset int64, text string, truncated bool)
+	diag   *diagnostics
+
+	f *os.File
+	// fi is the state of the file at the last check.
+	fi os.FileInfo
+	// pos is the number of bytes read from the current file.
+	pos int64
+	// head holds the first bytes read from the current file.
+	head []byte
+	// line and offset are the number and position of the next line.
+	line   int
+	offset int64
+	// pending holds the start of a line not yet ended by a newline.
+	pending []byte
+	// skipping is set when pending reached maxLineSize and the rest
+	// of the line is dropped until its end.
+	skipping bool
+	// missing is set once the absence of the file has been reported.
+	missing bool
+}
+
+// open opens the followed file and resets the reading position.
+func (fw *follower) open() bool {
+	f, err := os.Open(fw.in.path)
+	if err != nil {
+		if !fw.missing {
+			log.Printf("%s: waiting for the file to appear - %v\n", fw.in.path, err)
+			fw.missing = true
+		}
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		fw.diag.fail(fw.in.path, err)
+		return false
+	}
+	fw.f, fw.fi, fw.missing = f, fi, false
+	fw.reset()
+	return true
+}
+
+// reset restarts the reading from the start of the file.
+func (fw *follower) reset() {
+	fw.pos, fw.line, fw.offset = 0, 1, 0
+	fw.head, fw.pending, fw.skipping = fw.head[:0], fw.pending[:0], false
+}
+
+// emit hands the pending line to the handler and moves to the next line.
+func (fw *follower) emit(size int64) {
+	text := string(bytes.TrimSuffix(fw.pending, []byte("\r")))
+	fw.handle(fw.line, fw.offset, text, fw.skipping)
+	fw.line++
+	fw.offset += size
+	fw.pending, fw.skipping = fw.pending[:0], false
+}
+
+// consume splits data into lines. The last incomplete line stays pending.
+func (fw *follower) consume(data []byte) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		chunk := data
+		if i >= 0 {
+			chunk = data[:i]
+		}
+		if room := maxLineSize - len(fw.pending); len(chunk) > room {
+			fw.pending = append(fw.pending, chunk[:room]...)
+			fw.skipping = true
+		} else if !fw.skipping {
+			fw.pending = append(fw.pending, chunk...)
+		}
+		if i < 0 {
+			return
+		}
+		// size of the line, ending included, from the file.
+		size := fw.pos - fw.offset - int64(len(data)) + int64(i) + 1
+		fw.emit(size)
+		data = data[i+1:]
+	}
+}
+
+// readAvailable reads the file up to its current end.
+func (fw *follower) readAvailable(buf []byte) {
+	for {
+		n, err := fw.f.Read(buf)
+		if room := headSize - len(fw.head); room > 0 {
+			fw.head = append(fw.head, buf[:min(n, room)]...)
+		}
+		fw.pos += int64(n)
+		fw.consume(buf[:n])
+		if errors.Is(err, io.EOF) || (err == nil && n == 0) {
+			return
+		}
+		if err != nil {
+			fw.diag.fail(fw.in.path, err)
+			fw.close()
+			return
+		}
+	}
+}
+
+// close closes the current file. A pending line without newline is
+// considered complete since nothing will be appended to it anymore.
+func (fw *follower) close() {
+	if len(fw.pending) > 0 || fw.skipping {
+		fw.emit(fw.pos - fw.offset)
+	}
+	fw.f.Close()
+	fw.f = nil
+}
+
+// rewritten reports whether the first bytes of the file differ from
+// those read before, like after a copytruncate followed by fast writes.
+func (fw *follower) rewritten() bool {
+	head := make([]byte, len(fw.head))
+	n, err := fw.f.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false
+	}
+	return !bytes.Equal(head[:n], fw.head)
+}
+
+// truncated reports whether the followed file shrank below the reading
+// position or was rewritten. The start of the file is only compared when
+// its size or modification time changed since the last check.
+func (fw *follower) truncated() bool {
+	fi, err := fw.f.Stat()
+	if err != nil {
+		return false
+	}
+	changed := fi.Size() != fw.fi.Size() || !fi.ModTime().Equal(fw.fi.ModTime())
+	fw.fi = fi
+	return fi.Size() < fw.pos || (changed && fw.rewritten())
+}
+
+// restart reads the followed file again from its start.
+func (fw *follower) restart() bool {
+	log.Printf("%s: file truncated or rewritten - reading from its start\n", fw.in.path)
+	if _, err := fw.f.Seek(0, io.SeekStart); err != nil {
+		fw.diag.fail(fw.in.path, err)
+		fw.close()
+		return false
+	}
+	fw.reset()
+	return true
+}
+
+// check detects a rotation, a truncation or a rewrite of the followed file
+// and reports whether the file must be read again right away.
+func (fw *follower) check() bool {
+	fi, err := os.Stat(fw.in.path)
+	if err != nil {
+		// removed: keep the current file until a new one is created.
+		return false
+	}
+	if !os.SameFile(fi, fw.fi) {
+		fw.close()
+		return fw.open()
+	}
+	return fw.truncated() && fw.restart()
+}
+
+// followInput reads the file of in from its start then keeps watching it
+// every opts.followInterval until ctx is done. The file can be missing at
+// start, rotated or truncated, as with `tail -F`.
+func followInput(ctx context.Context, in input, opts options, diag *diagnostics, out chan<- record) {
+	fw := &follower{in: in, handle: lineHandler(ctx, in, opts, diag, out), diag: diag}
+	buf := make([]byte, 32*1024)
+	ticker := time.NewTicker(opts.followInterval)
+	defer ticker.Stop()
+	for {
+		// a rewrite is detected before reading so the new content is
+		// not read from the previous position.
+		if fw.f == nil {
+			fw.open()
+		} else if fw.truncated() {
+			fw.restart()
+		}
+		for fw.f != nil {
+			fw.readAvailable(buf)
+			if fw.f == nil || !fw.check() {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if fw.f != nil {
+				fw.close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// uniqueRecords forwards each record whose entry was never seen before.
+func uniqueRecords(records <-chan record) <-chan record {
+	type key struct {
+		prefix netip.Prefix
+		zone   string
+	}
+	out := make(chan record, cap(records))
+	go func() {
+		defer close(out)
+		seen := make(map[key]struct{})
+		for r := range records {
+			k := key{prefix: r.prefix, zone: r.zone}
+			if _, found := seen[k]; found {
+				continue
+			}
+			seen[k] = struct{}{}
+			out <- r
+		}
+	}()
+	return out
+}
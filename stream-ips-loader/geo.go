@@ -0,0 +1,136 @@
+package main
+
+// This file contains the offline enrichment of records with their country, ASN
+// and organisation found into local MaxMind DB files, and the related filters.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// stringsFlag is a flag which can be repeated to build a list.
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
+
+func (sf *stringsFlag) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
+}
+
+// geoInfo is what the databases know about an address.
+type geoInfo struct {
+	country string
+	asn     uint64
+	org     string
+}
+
+// mapPath returns the value found by following the keys into nested maps.
+func mapPath(data map[string]any, keys ...string) any {
+	var value any = data
+	for _, key := range keys {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// geoLookup merges the informations found into all databases. The first
+// database which knows a given field wins, so a country database and an
+// ASN database can be combined.
+func geoLookup(dbs []*mmdbReader, r record) geoInfo {
+	var info geoInfo
+	for _, db := range dbs {
+		data, err := db.lookup(r.prefix.Addr())
+		if err != nil {
+			log.Printf("%s: lookup of %s failed - %v\n", db.path, r.prefix.Addr(), err)
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		if info.country == "" {
+			info.country, _ = mapPath(data, "country", "iso_code").(string)
+		}
+		if info.country == "" {
+			info.country, _ = mapPath(data, "registered_country", "iso_code").(string)
+		}
+		if info.asn == 0 {
+			info.asn = toUint64(data["autonomous_system_number"])
+		}
+		if info.org == "" {
+			info.org, _ = data["autonomous_system_organization"].(string)
+		}
+		if info.org == "" {
+			info.org, _ = data["organization"].(string)
+		}
+	}
+	return info
+}
+
+// geoFilter keeps the records of some countries or ASNs only.
+type geoFilter struct {
+	countries map[string]bool
+	asns      map[uint64]bool
+}
+
+// newGeoFilter builds a filter from comma separated lists of
+// country ISO codes and autonomous system numbers. The filter needs
+// at least one of the databases, otherwise it could not drop anything.
+func newGeoFilter(countries, asns string, databases int) (geoFilter, error) {
+	f := geoFilter{countries: make(map[string]bool), asns: make(map[uint64]bool)}
+	for _, c := range strings.Split(countries, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			f.countries[c] = true
+		}
+	}
+	for _, a := range strings.Split(asns, ",") {
+		a = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(a)), "AS")
+		if a == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(a, 10, 32)
+		if err != nil {
+			return f, fmt.Errorf("invalid autonomous system number %q", a)
+		}
+		f.asns[n] = true
+	}
+	if databases == 0 && (len(f.countries) > 0 || len(f.asns) > 0) {
+		return f, errors.New("the -country and -asn filters require a -mmdb database")
+	}
+	return f, nil
+}
+
+// keep reports whether a record with the given informations passes the filter.
+func (f geoFilter) keep(info geoInfo) bool {
+	if len(f.countries) > 0 && !f.countries[info.country] {
+		return false
+	}
+	return len(f.asns) == 0 || f.asns[info.asn]
+}
+
+// enrichRecords annotates each record with the databases informations
+// and only forwards those which pass the filter.
+func enrichRecords(records <-chan record, dbs []*mmdbReader, f geoFilter) <-chan record {
+	out := make(chan record, cap(records))
+	go func() {
+		defer close(out)
+		for r := range records {
+			info := geoLookup(dbs, r)
+			if !f.keep(info) {
+				continue
+			}
+			r.country, r.asn, r.org = info.country, info.asn, info.org
+			out <- r
+		}
+	}()
+	return out
+}
@@ -0,0 +1,187 @@
+package ipset
+
+// This file contains the parsing of single addresses, CIDR blocks and dash ranges
+// along with the few arithmetic helpers needed to turn any range into prefixes.
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"strings"
+)
+
+// u128 is an unsigned 128 bits integer used for addresses arithmetic.
+// IPv4 addresses are stored into the lowest 32 bits.
+type u128 struct {
+	hi, lo uint64
+}
+
+// addrToU128 converts an address into its integer value.
+func addrToU128(a netip.Addr) u128 {
+	if a.Is4() {
+		b := a.As4()
+		return u128{lo: uint64(b[0])<<24 | uint64(b[1])<<16 | uint64(b[2])<<8 | uint64(b[3])}
+	}
+	b := a.As16()
+	var v u128
+	for i := 0; i < 8; i++ {
+		v.hi = v.hi<<8 | uint64(b[i])
+		v.lo = v.lo<<8 | uint64(b[i+8])
+	}
+	return v
+}
+
+// u128ToAddr converts an integer value back to an address of the given family.
+func u128ToAddr(v u128, is4 bool) netip.Addr {
+	if is4 {
+		return netip.AddrFrom4([4]byte{byte(v.lo >> 24), byte(v.lo >> 16), byte(v.lo >> 8), byte(v.lo)})
+	}
+	var b [16]byte
+	for i := 7; i >= 0; i-- {
+		b[i] = byte(v.hi)
+		b[i+8] = byte(v.lo)
+		v.hi >>= 8
+		v.lo >>= 8
+	}
+	return netip.AddrFrom16(b)
+}
+
+// add returns v+n and reports whether the operation overflowed.
+func (v u128) add(n u128) (u128, bool) {
+	lo, carry := bits.Add64(v.lo, n.lo, 0)
+	hi, carry := bits.Add64(v.hi, n.hi, carry)
+	return u128{hi: hi, lo: lo}, carry != 0
+}
+
+// sub returns v-n. Callers ensure that v >= n.
+func (v u128) sub(n u128) u128 {
+	lo, borrow := bits.Sub64(v.lo, n.lo, 0)
+	hi, _ := bits.Sub64(v.hi, n.hi, borrow)
+	return u128{hi: hi, lo: lo}
+}
+
+// cmp returns -1, 0 or +1 depending on whether v is lower, equal or greater than n.
+func (v u128) cmp(n u128) int {
+	switch {
+	case v.hi < n.hi, v.hi == n.hi && v.lo < n.lo:
+		return -1
+	case v == n:
+		return 0
+	}
+	return 1
+}
+
+// trailingZeros returns the number of trailing zero bits of v.
+func (v u128) trailingZeros() int {
+	if v.lo != 0 {
+		return bits.TrailingZeros64(v.lo)
+	}
+	return 64 + bits.TrailingZeros64(v.hi)
+}
+
+// pow2 returns 2^n for n lower than 128.
+func pow2(n int) u128 {
+	if n >= 64 {
+		return u128{hi: 1 << (n - 64)}
+	}
+	return u128{lo: 1 << n}
+}
+
+// ones returns 2^n-1 for n up to 128, the offset of the last address of
+// a block of n host bits.
+func ones(n int) u128 {
+	if n >= 128 {
+		return u128{hi: ^uint64(0), lo: ^uint64(0)}
+	}
+	return pow2(n).sub(u128{lo: 1})
+}
+
+// LastAddr returns the highest address covered by the prefix p.
+func LastAddr(p netip.Prefix) netip.Addr {
+	first := addrToU128(p.Addr())
+	last, _ := first.add(ones(p.Addr().BitLen() - p.Bits()))
+	return u128ToAddr(last, p.Addr().Is4())
+}
+
+// rangeToPrefixes returns the smallest list of prefixes which exactly
+// covers all addresses from `from` to `to` (both included). Both bounds
+// must be of the same family and `from` must not be greater than `to`.
+func rangeToPrefixes(from, to netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	is4, bitLen := from.Is4(), from.BitLen()
+	start, end := addrToU128(from), addrToU128(to)
+	for start.cmp(end) <= 0 {
+		// largest block aligned on start which does not go beyond end.
+		host := start.trailingZeros()
+		if host > bitLen {
+			host = bitLen
+		}
+		for host > 0 {
+			last, overflow := start.add(ones(host))
+			if !overflow && last.cmp(end) <= 0 {
+				break
+			}
+			host--
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(u128ToAddr(start, is4), bitLen-host))
+		// the whole address space, whose size 2^128 does not fit for IPv6.
+		if host == bitLen {
+			break
+		}
+		next, overflow := start.add(pow2(host))
+		if overflow || (is4 && next.lo > 0xffffffff) {
+			break
+		}
+		start = next
+	}
+	return prefixes
+}
+
+// HostPrefix returns the single address prefix of a.
+func HostPrefix(a netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(a, a.BitLen())
+}
+
+// ParseEntry parses a trimmed line which can be a single address, a CIDR block
+// (e.g. 10.0.0.0/8) or a dash range (e.g. 192.168.1.10-192.168.1.50) of
+// either family. It returns the prefixes covered by the entry. Host bits
+// of CIDR blocks are cleared, so 10.1.2.3/8 is the same as 10.0.0.0/8.
+func ParseEntry(s string) ([]netip.Prefix, error) {
+	if s == "" {
+		return nil, errors.New("empty entry")
+	}
+
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		return []netip.Prefix{p.Masked()}, nil
+	}
+
+	if first, second, found := strings.Cut(s, "-"); found {
+		from, err := netip.ParseAddr(strings.TrimSpace(first))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range start: %w", err)
+		}
+		to, err := netip.ParseAddr(strings.TrimSpace(second))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range end: %w", err)
+		}
+		from, to = from.WithZone(""), to.WithZone("")
+		if from.Is4() != to.Is4() {
+			return nil, errors.New("range bounds are not of the same family")
+		}
+		if to.Less(from) {
+			return nil, errors.New("range start is greater than range end")
+		}
+		return rangeToPrefixes(from, to), nil
+	}
+
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return nil, err
+	}
+	return []netip.Prefix{HostPrefix(a)}, nil
+}
@@ -0,0 +1,352 @@
+// Package ipset builds immutable sets of IPv4 and IPv6 addresses from the same
+// sources as the stream-ips-loader program: single addresses, CIDR blocks and
+// dash ranges, one per line. A Set is stored as sorted disjoint ranges so that
+// membership lookups are logarithmic, and it is safe for concurrent reads.
+//
+// A typical use is an HTTP middleware rejecting blocked clients:
+//
+//	var b ipset.Builder
+//	if err := b.LoadFile("blocklist.txt"); err != nil {
+//		log.Println(err)
+//	}
+//	blocked := b.Set()
+//
+//	func middleware(next http.Handler) http.Handler {
+//		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//			ap, err := netip.ParseAddrPort(r.RemoteAddr)
+//			if err == nil && blocked.Contains(ap.Addr()) {
+//				http.Error(w, "forbidden", http.StatusForbidden)
+//				return
+//			}
+//			next.ServeHTTP(w, r)
+//		})
+//	}
+package ipset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Range is an inclusive interval of addresses of the same family.
+type Range struct {
+	From, To netip.Addr
+}
+
+// PrefixRange returns the interval of addresses covered by p.
+func PrefixRange(p netip.Prefix) Range {
+	p = p.Masked()
+	return Range{From: p.Addr(), To: LastAddr(p)}
+}
+
+// Contains reports whether a is into the range.
+func (r Range) Contains(a netip.Addr) bool {
+	return r.From.Compare(a) <= 0 && a.Compare(r.To) <= 0
+}
+
+// Prefixes returns the smallest list of prefixes covering the range.
+func (r Range) Prefixes() []netip.Prefix {
+	return rangeToPrefixes(r.From, r.To)
+}
+
+// MergeRanges sorts the ranges and merges those which overlap or are adjacent.
+// The returned list is sorted, IPv4 ranges first, and contains disjoint ranges.
+// The ranges slice is sorted in place.
+func MergeRanges(ranges []Range) []Range {
+	if len(ranges) == 0 {
+		return nil
+	}
+	slices.SortFunc(ranges, func(a, b Range) int {
+		return a.From.Compare(b.From)
+	})
+
+	merged := []Range{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		// next is invalid when last ends on the highest address of its family.
+		next := last.To.Next()
+		if r.From.Is4() == last.To.Is4() && (!next.IsValid() || r.From.Compare(next) <= 0) {
+			if r.To.Compare(last.To) > 0 {
+				last.To = r.To
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// RangesPrefixes returns the smallest list of prefixes covering the ranges.
+func RangesPrefixes(ranges []Range) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range ranges {
+		prefixes = append(prefixes, r.Prefixes()...)
+	}
+	return prefixes
+}
+
+// Set is an immutable set of addresses. The zero value is an empty set.
+// All methods are safe for concurrent use.
+type Set struct {
+	// ranges are sorted and disjoint, IPv4 ranges first.
+	ranges []Range
+}
+
+// FromPrefixes returns the set of addresses covered by the prefixes.
+func FromPrefixes(prefixes ...netip.Prefix) *Set {
+	var b Builder
+	for _, p := range prefixes {
+		b.Add(p)
+	}
+	return b.Set()
+}
+
+// find returns the index of the range containing a or -1.
+func (s *Set) find(a netip.Addr) int {
+	a = a.WithZone("")
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i].To.Compare(a) >= 0
+	})
+	if i < len(s.ranges) && s.ranges[i].From.Compare(a) <= 0 {
+		return i
+	}
+	if a.Is4In6() {
+		return s.find(a.Unmap())
+	}
+	return -1
+}
+
+// Contains reports whether a is into the set. The zone of a is ignored and an
+// IPv4-mapped IPv6 address also matches its IPv4 counterpart.
+func (s *Set) Contains(a netip.Addr) bool {
+	return s.find(a) >= 0
+}
+
+// Lookup returns the prefix of the canonical form of the set which contains a,
+// that is the largest aligned block around a which fits into its range.
+func (s *Set) Lookup(a netip.Addr) (netip.Prefix, bool) {
+	i := s.find(a)
+	if i < 0 {
+		return netip.Prefix{}, false
+	}
+	r := s.ranges[i]
+	if a = a.WithZone(""); a.Is4In6() && !r.Contains(a) {
+		a = a.Unmap()
+	}
+	for bits := 0; bits <= a.BitLen(); bits++ {
+		p := netip.PrefixFrom(a, bits).Masked()
+		if r.From.Compare(p.Addr()) <= 0 && LastAddr(p).Compare(r.To) <= 0 {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// ContainsPrefix reports whether every address of p is into the set.
+func (s *Set) ContainsPrefix(p netip.Prefix) bool {
+	r := PrefixRange(p)
+	i := s.find(r.From)
+	return i >= 0 && r.To.Compare(s.ranges[i].To) <= 0
+}
+
+// Len returns the number of disjoint ranges of the set.
+func (s *Set) Len() int {
+	return len(s.ranges)
+}
+
+// Ranges returns a copy of the sorted disjoint ranges of the set.
+func (s *Set) Ranges() []Range {
+	return slices.Clone(s.ranges)
+}
+
+// Prefixes returns the canonical form of the set: the smallest sorted
+// list of prefixes covering the same addresses.
+func (s *Set) Prefixes() []netip.Prefix {
+	return RangesPrefixes(s.ranges)
+}
+
+// Union returns the addresses which are in s or in o.
+func (s *Set) Union(o *Set) *Set {
+	all := make([]Range, 0, len(s.ranges)+len(o.ranges))
+	all = append(all, s.ranges...)
+	return &Set{ranges: MergeRanges(append(all, o.ranges...))}
+}
+
+// minAddr returns the lowest of two addresses.
+func minAddr(a, b netip.Addr) netip.Addr {
+	if a.Compare(b) < 0 {
+		return a
+	}
+	return b
+}
+
+// maxAddr returns the highest of two addresses.
+func maxAddr(a, b netip.Addr) netip.Addr {
+	if a.Compare(b) > 0 {
+		return a
+	}
+	return b
+}
+
+// Intersect returns the addresses which are both in s and in o.
+func (s *Set) Intersect(o *Set) *Set {
+	a, b := s.ranges, o.ranges
+	var result []Range
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		from, to := maxAddr(a[i].From, b[j].From), minAddr(a[i].To, b[j].To)
+		if from.Compare(to) <= 0 {
+			result = append(result, Range{From: from, To: to})
+		}
+		// move forward the range which ends first.
+		if a[i].To.Compare(b[j].To) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return &Set{ranges: result}
+}
+
+// Difference returns the addresses which are in s but not in o.
+func (s *Set) Difference(o *Set) *Set {
+	b := o.ranges
+	var result []Range
+	j := 0
+	for _, r := range s.ranges {
+		cur, done := r.From, false
+		// skip the ranges of o which end before the current one.
+		for j < len(b) && b[j].To.Compare(cur) < 0 {
+			j++
+		}
+		for k := j; k < len(b) && b[k].From.Compare(r.To) <= 0; k++ {
+			if b[k].From.Compare(cur) > 0 {
+				result = append(result, Range{From: cur, To: b[k].From.Prev()})
+			}
+			if b[k].To.Compare(r.To) >= 0 {
+				done = true
+				break
+			}
+			cur = b[k].To.Next()
+		}
+		if !done {
+			result = append(result, Range{From: cur, To: r.To})
+		}
+	}
+	return &Set{ranges: result}
+}
+
+// SymmetricDifference returns the addresses which are either in s or in o but not in both.
+func (s *Set) SymmetricDifference(o *Set) *Set {
+	return s.Difference(o).Union(o.Difference(s))
+}
+
+// compactThreshold is the minimum number of ranges a Builder accumulates
+// on top of the merged ones before merging them again.
+const compactThreshold = 64 * 1024
+
+// Builder accumulates addresses to build a Set. It merges them from time to
+// time so that its memory only grows with the number of disjoint ranges seen.
+// The zero value is ready to use. A Builder is not safe for concurrent use.
+type Builder struct {
+	ranges []Range
+	// merged is the number of ranges after the latest merge.
+	merged int
+}
+
+// AddRange adds the addresses of r.
+func (b *Builder) AddRange(r Range) {
+	b.ranges = append(b.ranges, r)
+	// waiting for as many new ranges as merged ones keeps the cost amortized.
+	if len(b.ranges)-b.merged >= max(compactThreshold, b.merged) {
+		b.ranges = MergeRanges(b.ranges)
+		b.merged = len(b.ranges)
+	}
+}
+
+// Add adds the addresses covered by p.
+func (b *Builder) Add(p netip.Prefix) {
+	b.AddRange(PrefixRange(p))
+}
+
+// AddEntry parses s with ParseEntry and adds its addresses.
+func (b *Builder) AddEntry(s string) error {
+	prefixes, err := ParseEntry(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	for _, p := range prefixes {
+		b.Add(p)
+	}
+	return nil
+}
+
+// LoadError reports the invalid lines met by Load.
+type LoadError struct {
+	// Line and Err describe the first invalid line.
+	Line int
+	Err  error
+	// Rejected is the total number of invalid lines.
+	Rejected int
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("line %d: %v (%d invalid lines)", e.Line, e.Err, e.Rejected)
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// Load adds the entries read from r, one per line. Empty lines and comments
+// starting with # are ignored. Invalid lines are skipped and reported by a
+// *LoadError once all valid entries are added.
+func (b *Builder) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	var loadErr *LoadError
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := b.AddEntry(line); err != nil {
+			if loadErr == nil {
+				loadErr = &LoadError{Line: n, Err: err}
+			}
+			loadErr.Rejected++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if loadErr != nil {
+		return loadErr
+	}
+	return nil
+}
+
+// LoadFile adds the entries of the file at path. See Load.
+func (b *Builder) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := b.Load(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Set returns the set of all added addresses. The Builder can still be used
+// afterwards and later additions do not change the returned Set.
+func (b *Builder) Set() *Set {
+	b.ranges = MergeRanges(b.ranges)
+	b.merged = len(b.ranges)
+	return &Set{ranges: slices.Clone(b.ranges)}
+}
@@ -0,0 +1,177 @@
+package ipset
+
+// Basic test file for <ipset> package.
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// mustSet builds a set from entries and fails the test on any invalid one.
+func mustSet(t *testing.T, entries ...string) *Set {
+	t.Helper()
+	var b Builder
+	for _, e := range entries {
+		if err := b.AddEntry(e); err != nil {
+			t.Fatalf("invalid entry %q: %v", e, err)
+		}
+	}
+	return b.Set()
+}
+
+// prefixesStrings returns the textual form of the set prefixes.
+func prefixesStrings(s *Set) []string {
+	var out []string
+	for _, p := range s.Prefixes() {
+		out = append(out, p.String())
+	}
+	return out
+}
+
+func TestParseEntry(t *testing.T) {
+	tests := []struct {
+		entry    string
+		expected []string
+	}{
+		{"10.1.2.3", []string{"10.1.2.3/32"}},
+		{"10.1.2.3/8", []string{"10.0.0.0/8"}},
+		{"192.168.1.10-192.168.1.17", []string{"192.168.1.10/31", "192.168.1.12/30", "192.168.1.16/31"}},
+		{"0.0.0.0-255.255.255.255", []string{"0.0.0.0/0"}},
+		{"::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}},
+		{"::-7fff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/1"}},
+		{"8000::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"8000::/1"}},
+		{"2001:db8::-2001:db8::ff", []string{"2001:db8::/120"}},
+	}
+	for _, tt := range tests {
+		prefixes, err := ParseEntry(tt.entry)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.entry, err)
+			continue
+		}
+		var got []string
+		for _, p := range prefixes {
+			got = append(got, p.String())
+		}
+		if !slices.Equal(got, tt.expected) {
+			t.Errorf("%q: expected %v but got %v", tt.entry, tt.expected, got)
+		}
+	}
+
+	for _, entry := range []string{"", "10.0.0.300", "10.0.0.9-10.0.0.1", "10.0.0.1-::1", "10.0.0.0/33"} {
+		if _, err := ParseEntry(entry); err == nil {
+			t.Errorf("%q: expected an error but got nil", entry)
+		}
+	}
+}
+
+func TestSetLookups(t *testing.T) {
+	s := mustSet(t, "10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "10.0.0.5")
+
+	for _, addr := range []string{"10.1.2.3", "192.0.2.1", "2001:db8::1", "::ffff:10.0.0.1", "2001:db8::2%eth0"} {
+		if !s.Contains(netip.MustParseAddr(addr)) {
+			t.Errorf("expected %s to be into the set", addr)
+		}
+	}
+	for _, addr := range []string{"11.0.0.0", "192.0.2.2", "2001:db9::1", "::1"} {
+		if s.Contains(netip.MustParseAddr(addr)) {
+			t.Errorf("expected %s not to be into the set", addr)
+		}
+	}
+
+	p, found := s.Lookup(netip.MustParseAddr("10.20.30.40"))
+	if !found || p != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Errorf("expected 10.0.0.0/8 but got %v (%v)", p, found)
+	}
+	lookups := []struct {
+		set      *Set
+		addr     string
+		expected string
+	}{
+		{s, "::ffff:10.0.0.1", "10.0.0.0/8"},
+		{s, "2001:db8::2%eth0", "2001:db8::/32"},
+		{mustSet(t, "10.0.0.1-10.0.0.6"), "10.0.0.5", "10.0.0.4/31"},
+		{mustSet(t, "10.0.0.1-10.0.0.6"), "10.0.0.1", "10.0.0.1/32"},
+		{mustSet(t, "10.0.0.1-10.0.0.6"), "10.0.0.3", "10.0.0.2/31"},
+		{mustSet(t, "::/0"), "2001:db8::1", "::/0"},
+		{mustSet(t, "0.0.0.0/0"), "255.255.255.255", "0.0.0.0/0"},
+		{mustSet(t, "::1-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), "8000::1", "8000::/1"},
+	}
+	for _, tt := range lookups {
+		p, found := tt.set.Lookup(netip.MustParseAddr(tt.addr))
+		if !found || p.String() != tt.expected {
+			t.Errorf("lookup %s: expected %s but got %v (%v)", tt.addr, tt.expected, p, found)
+		}
+	}
+	if p, found := s.Lookup(netip.MustParseAddr("11.0.0.0")); found {
+		t.Errorf("expected no prefix but got %v", p)
+	}
+	if !s.ContainsPrefix(netip.MustParsePrefix("10.20.0.0/16")) || s.ContainsPrefix(netip.MustParsePrefix("192.0.2.0/24")) {
+		t.Error("unexpected ContainsPrefix result")
+	}
+	if s.Len() != 3 {
+		t.Errorf("expected 3 ranges but got %d", s.Len())
+	}
+}
+
+func TestWholeAddressSpace(t *testing.T) {
+	all := mustSet(t, "::/0", "0.0.0.0/0")
+	if got, want := prefixesStrings(all), []string{"0.0.0.0/0", "::/0"}; !slices.Equal(got, want) {
+		t.Errorf("expected %v but got %v", want, got)
+	}
+	if got, want := prefixesStrings(all.Union(mustSet(t, "10.0.0.1", "::1"))), []string{"0.0.0.0/0", "::/0"}; !slices.Equal(got, want) {
+		t.Errorf("union: expected %v but got %v", want, got)
+	}
+	if got, want := prefixesStrings(all.Difference(mustSet(t, "128.0.0.0/1", "8000::/1"))), []string{"0.0.0.0/1", "::/1"}; !slices.Equal(got, want) {
+		t.Errorf("difference: expected %v but got %v", want, got)
+	}
+	for _, addr := range []string{"0.0.0.0", "255.255.255.255", "::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"} {
+		if !all.Contains(netip.MustParseAddr(addr)) {
+			t.Errorf("expected %s to be into the set", addr)
+		}
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	block := mustSet(t, "192.0.2.0/24", "2001:db8::/127")
+	allow := mustSet(t, "192.0.2.0", "192.0.2.128/25", "2001:db8::1")
+
+	tests := []struct {
+		name     string
+		result   *Set
+		expected []string
+	}{
+		{"union", block.Union(allow), []string{"192.0.2.0/24", "2001:db8::/127"}},
+		{"intersect", block.Intersect(allow), []string{"192.0.2.0/32", "192.0.2.128/25", "2001:db8::1/128"}},
+		{"difference", block.Difference(allow), []string{
+			"192.0.2.1/32", "192.0.2.2/31", "192.0.2.4/30", "192.0.2.8/29",
+			"192.0.2.16/28", "192.0.2.32/27", "192.0.2.64/26", "2001:db8::/128",
+		}},
+		{"symmetric difference", allow.SymmetricDifference(mustSet(t, "192.0.2.0/25")), []string{
+			"192.0.2.1/32", "192.0.2.2/31", "192.0.2.4/30", "192.0.2.8/29", "192.0.2.16/28",
+			"192.0.2.32/27", "192.0.2.64/26", "192.0.2.128/25", "2001:db8::1/128",
+		}},
+	}
+	for _, tt := range tests {
+		if got := prefixesStrings(tt.result); !slices.Equal(got, tt.expected) {
+			t.Errorf("%s: expected %v but got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestBuilderLoad(t *testing.T) {
+	var b Builder
+	err := b.Load(strings.NewReader("# feed\n10.0.0.1\r\n\n10.0.0.300\n10.0.0.0\nnope\n"))
+	var loadErr *LoadError
+	if !errors.As(err, &loadErr) {
+		t.Fatalf("expected a *LoadError but got %v", err)
+	}
+	if loadErr.Line != 4 || loadErr.Rejected != 2 {
+		t.Errorf("expected first rejection on line 4 and 2 rejections but got %d and %d", loadErr.Line, loadErr.Rejected)
+	}
+	if got := prefixesStrings(b.Set()); !slices.Equal(got, []string{"10.0.0.0/31"}) {
+		t.Errorf("expected [10.0.0.0/31] but got %v", got)
+	}
+}
@@ -2,79 +2,371 @@ package main
 
 // This is a small go-based nice demonstration of loading multiple ip addresses from pipe input data and
 // from any number of files passed as program arguments. It processes all data and store on valid ips.
+// Sources are streamed concurrently and each valid entry is written as soon as it is loaded. The other
+// modes and options are shown with the examples at the end of this file.
 
 // Version  : 1.0
 // Author   : Jerome AMON
 // Created  : 19 November 2021
 
 import (
-	"fmt"
+	"bufio"
+	"context"
+	"flag"
 	"io"
-	"net"
+	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jeamon/gosnippets/stream-ips-loader/ipset"
 )
 
-// isValidIP takes a supposed ip address and returns true if it is valid.
-func isValidIP(ip string) bool {
-	return net.ParseIP(ip) != nil
+// options holds the settings which drive the loading.
+type options struct {
+	// expand turns each block or range into its single addresses.
+	expand bool
+	// expandLimit is the maximum number of addresses an entry can
+	// cover to be expanded. Bigger entries are kept as prefixes.
+	expandLimit int
+	// canonical collapses the loaded entries into a minimal sorted list of prefixes.
+	canonical bool
+	// workers is the maximum number of files read at the same time.
+	workers int
+	// extract searches addresses everywhere into the lines.
+	extract bool
+	// include and exclude are the comma separated categories to keep or to drop.
+	include, exclude string
+	// op is the set operation applied between the named inputs.
+	op string
+	// mmdbPaths are the MaxMind databases used to enrich the records.
+	mmdbPaths stringsFlag
+	// countries and asns are the comma separated lists of countries and
+	// autonomous system numbers to keep.
+	countries, asns string
+	// cacheDir is the directory where remote sources are cached.
+	cacheDir string
+	// httpTimeout is the timeout of a single remote source download.
+	httpTimeout time.Duration
+	// httpRetries is the number of retries of a download failed by a transient error.
+	httpRetries int
+	// report is the file where rejections and the summary are written.
+	// A dash means the standard error.
+	report string
+	// strict makes the program fail when any entry is rejected or flagged.
+	strict bool
+	// follow keeps watching the files for new lines like `tail -F`.
+	follow bool
+	// followInterval is the delay between two checks of followed files.
+	followInterval time.Duration
+	// count tallies the occurrences instead of writing the entries.
+	count bool
+	// top is the number of most frequent entries reported by the count mode.
+	top int
+	// countV4Bits and countV6Bits are the aggregation prefix lengths.
+	countV4Bits, countV6Bits int
+	// histogram is the file where the full counts are written.
+	histogram string
+	// histogramFormat is csv or json. It defaults to the file extension.
+	histogramFormat string
+	// unmap converts IPv4-mapped IPv6 addresses into IPv4 addresses.
+	unmap bool
+	// stripZone drops the zone of IPv6 addresses.
+	stripZone bool
+	// leadingZeros is the policy for IPv4 octets with leading zeros.
+	leadingZeros string
+	// recursive walks the directories given as arguments recursively.
+	recursive bool
+	// includeFiles and excludeFiles are comma separated glob patterns
+	// matched against the names of the discovered files.
+	includeFiles, excludeFiles string
+	// serve is the listen address of the server mode, if not empty.
+	serve string
+	// reloadInterval is the delay between two checks of the served lists sources.
+	reloadInterval time.Duration
+	// feedInterval is the minimum delay between two downloads of a served remote feed.
+	feedInterval time.Duration
+	// format is the name of the output format.
+	format string
+	// setName is the set name used by the ipset and nft formats.
+	setName string
+	// chain is the chain used by the iptables format.
+	chain string
 }
 
 // loadInfos loads data piped and from all files passed
-// as program arguments and fill the pointer of slice
-// with valid IP addresses.
-func loadInfos(ips *[]string) {
-
-	var entries []string
-
-	// retrieve standard input info.
-	fi, _ := os.Stdin.Stat()
-
-	if (fi.Mode() & os.ModeCharDevice) == 0 {
-		// there is data is from pipe, so grab the
-		// full content and build a list of entries.
-		content, _ := io.ReadAll(os.Stdin)
-		entries = strings.Split(string(content), "\n")
-
-	}
-
-	// parse any files content.
-	filenames := os.Args[1:]
-
-	if len(filenames) > 0 {
-		// for each valid file path, grab its full
-		// content and build a list of entries.
-		var lines []string
-		for _, file := range filenames {
-			content, err := os.ReadFile(file)
-			if err != nil {
-				continue
-			}
-			// construct the list based on "\n" as sep.
-			// then add lines content to entries list.
-			lines = strings.Split(string(content), "\n")
-			entries = append(entries, lines...)
+// as program arguments - directories, glob patterns and
+// @listfiles included - and streams the valid IP addresses
+// and prefixes on the returned channel. Rejected lines
+// and unreadable sources are reported to diag. In follow
+// mode the files are watched until ctx is done.
+func loadInfos(ctx context.Context, opts options, diag *diagnostics) <-chan record {
+	inputs := discoverInputs(parseInputs(flag.Args()), opts, diag)
+	return streamInfos(ctx, inputs, opts, diag)
+}
+
+// writeRecords writes all records with the given writer. The
+// flush function, if not nil, is called after each record.
+func writeRecords(rw recordWriter, records <-chan record, flush func() error) error {
+	if err := rw.begin(); err != nil {
+		return err
+	}
+	for r := range records {
+		if err := rw.write(r); err != nil {
+			return err
+		}
+		if flush == nil {
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
 		}
 	}
+	return rw.end()
+}
 
-	if len(entries) == 0 {
-		// no data input.
-		return
+// canonicalRecords collects all records and returns a channel of
+// their canonical form once every source is fully read.
+func canonicalRecords(records <-chan record) <-chan record {
+	var b ipset.Builder
+	for r := range records {
+		b.Add(r.prefix)
+	}
+	prefixes := b.Set().Prefixes()
+	out := make(chan record, len(prefixes))
+	for _, p := range prefixes {
+		out <- record{prefix: p, category: classify(p)}
 	}
+	close(out)
+	return out
+}
 
-	// keep only valid IP addresses.
-	for _, e := range entries {
-		if isValidIP(strings.TrimSpace(e)) {
-			*ips = append(*ips, strings.TrimSpace(e))
-		}
+// countRecords tallies all records then writes the top entries
+// to w and the full histogram to the -histogram file, if set.
+func countRecords(w io.Writer, records <-chan record, opts options) error {
+	c, err := newCounter(opts.countV4Bits, opts.countV6Bits)
+	if err != nil {
+		return err
+	}
+	format, err := histogramFormat(opts.histogramFormat, opts.histogram)
+	if err != nil {
+		return err
+	}
+	for r := range records {
+		c.add(r.prefix)
+	}
+	c.writeReport(w, opts.top)
+	if opts.histogram == "" {
+		return nil
 	}
+	f, err := os.Create(opts.histogram)
+	if err != nil {
+		return err
+	}
+	if err := c.writeHistogram(f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 func main() {
-	// hold all ips to process.
-	var ips []string
-	loadInfos(&ips)
-	fmt.Println(ips)
+	var opts options
+	flag.BoolVar(&opts.expand, "expand", false, "expand blocks and ranges into single addresses")
+	flag.IntVar(&opts.expandLimit, "expand-limit", 256, "maximum number of addresses of an entry to be expanded")
+	flag.BoolVar(&opts.canonical, "canonical", false, "deduplicate, sort and merge into the smallest list of prefixes")
+	flag.IntVar(&opts.workers, "workers", 4, "maximum number of files read at the same time")
+	flag.BoolVar(&opts.extract, "extract", false, "extract addresses embedded into free-form text such as logs")
+	flag.StringVar(&opts.include, "include", "", "comma separated categories to keep: "+strings.Join(categories, ", "))
+	flag.StringVar(&opts.exclude, "exclude", "", "comma separated categories to drop")
+	flag.StringVar(&opts.op, "op", "", "set operation applied from left to right between inputs: "+strings.Join(operationNames(), ", "))
+	flag.Var(&opts.mmdbPaths, "mmdb", "MaxMind database (.mmdb) used to add country, ASN and organisation - can be repeated")
+	flag.StringVar(&opts.countries, "country", "", "comma separated country ISO codes to keep - requires -mmdb")
+	flag.StringVar(&opts.asns, "asn", "", "comma separated autonomous system numbers to keep - requires -mmdb")
+	flag.StringVar(&opts.cacheDir, "cache-dir", defaultCacheDir(), "directory where http(s) sources are cached")
+	flag.DurationVar(&opts.httpTimeout, "http-timeout", 30*time.Second, "timeout of each http(s) source download")
+	flag.IntVar(&opts.httpRetries, "http-retries", 2, "number of retries of a http(s) source download failed by a network error, a 429 or a 5xx status")
+	flag.StringVar(&opts.report, "report", "", "file where rejected entries and a summary per source are written - use - for stderr")
+	flag.BoolVar(&opts.strict, "strict", false, "exit with a non-zero status if any entry is rejected or flagged or any source unreadable")
+	flag.BoolVar(&opts.follow, "follow", false, "keep watching the files for new lines and emit each new entry once, like tail -F")
+	flag.DurationVar(&opts.followInterval, "follow-interval", time.Second, "delay between two checks of followed files")
+	flag.BoolVar(&opts.count, "count", false, "count occurrences per address and per prefix and print the most frequent")
+	flag.IntVar(&opts.top, "top", 10, "number of most frequent addresses and prefixes printed by -count")
+	flag.IntVar(&opts.countV4Bits, "count-v4", 24, "prefix length used by -count to aggregate IPv4 addresses")
+	flag.IntVar(&opts.countV6Bits, "count-v6", 64, "prefix length used by -count to aggregate IPv6 addresses")
+	flag.StringVar(&opts.histogram, "histogram", "", "file where -count writes the full histogram")
+	flag.StringVar(&opts.histogramFormat, "histogram-format", "", "histogram format: csv or json - defaults to the file extension")
+	flag.BoolVar(&opts.unmap, "unmap", false, "convert IPv4-mapped IPv6 addresses like ::ffff:1.2.3.4 into IPv4 addresses")
+	flag.BoolVar(&opts.stripZone, "strip-zone", false, "drop the zone of IPv6 addresses like fe80::1%eth0")
+	flag.StringVar(&opts.leadingZeros, "leading-zeros", leadingZerosReject, "policy for IPv4 octets with leading zeros: reject, or decimal to accept and flag them")
+	flag.BoolVar(&opts.recursive, "recursive", false, "read the directories given as arguments recursively")
+	flag.StringVar(&opts.includeFiles, "include-files", "", "comma separated patterns of the discovered files names to read, like *.log")
+	flag.StringVar(&opts.excludeFiles, "exclude-files", "", "comma separated patterns of the discovered files names to skip, like *.old")
+	flag.StringVar(&opts.serve, "serve", "", "run a reputation lookup server of the lists on this address, like :8080")
+	flag.DurationVar(&opts.reloadInterval, "reload-interval", time.Minute, "delay between two checks of the served lists sources")
+	flag.DurationVar(&opts.feedInterval, "feed-interval", time.Hour, "minimum delay between two downloads of a served http(s) source")
+	flag.StringVar(&opts.format, "format", "plain", "output format: "+strings.Join(formatNames(), ", "))
+	flag.StringVar(&opts.setName, "set-name", "blocklist", "set name used by the ipset and nft formats")
+	flag.StringVar(&opts.chain, "chain", "INPUT", "chain used by the iptables format")
+	flag.Parse()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	rw, err := newRecordWriter(opts.format, out, opts)
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+
+	filter, err := newCategoryFilter(opts.include, opts.exclude)
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+
+	geo, err := newGeoFilter(opts.countries, opts.asns, len(opts.mmdbPaths))
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+
+	var dbs []*mmdbReader
+	for _, path := range opts.mmdbPaths {
+		db, err := openMMDB(path)
+		if err != nil {
+			log.Println("failed to open the MaxMind database -", err)
+			os.Exit(2)
+		}
+		dbs = append(dbs, db)
+	}
+
+	var report io.Writer
+	switch opts.report {
+	case "":
+	case "-":
+		report = os.Stderr
+	default:
+		f, err := os.Create(opts.report)
+		if err != nil {
+			log.Println("failed to create the report file -", err)
+			os.Exit(2)
+		}
+		defer f.Close()
+		report = f
+	}
+	diag := newDiagnostics(report)
+
+	if err := checkPatterns(splitPatterns(opts.includeFiles + "," + opts.excludeFiles)); err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+	if err := checkLeadingZeros(opts.leadingZeros); err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+	if opts.followInterval <= 0 {
+		log.Println("the follow interval must be positive")
+		os.Exit(2)
+	}
+	if opts.reloadInterval <= 0 {
+		log.Println("the reload interval must be positive")
+		os.Exit(2)
+	}
+	if opts.follow && (opts.canonical || opts.op != "") {
+		log.Println("the follow mode cannot be combined with -canonical or -op")
+		os.Exit(2)
+	}
+	if opts.count && (opts.canonical || opts.op != "") {
+		log.Println("the count mode cannot be combined with -canonical or -op")
+		os.Exit(2)
+	}
+	if opts.top < 1 {
+		log.Println("the top count must be at least 1")
+		os.Exit(2)
+	}
+	if _, err := newCounter(opts.countV4Bits, opts.countV6Bits); err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+	if _, err := histogramFormat(opts.histogramFormat, opts.histogram); err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+
+	// stop following the files on interruption and close the output properly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// a second signal kills the program if stopping takes too long.
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if opts.serve != "" {
+		if opts.follow || opts.count || opts.canonical || opts.op != "" {
+			log.Println("the server mode cannot be combined with -follow, -count, -canonical or -op")
+			os.Exit(2)
+		}
+		if err := newReputationServer(flag.Args(), opts, filter).serve(ctx, opts.serve, opts.reloadInterval); err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	records := classifyRecords(loadInfos(ctx, opts, diag), filter)
+	if len(dbs) > 0 {
+		records = enrichRecords(records, dbs, geo)
+	}
+	switch {
+	case opts.op != "":
+		if records, err = setRecords(records, parseInputs(flag.Args()), opts.op); err != nil {
+			log.Println(err)
+			os.Exit(2)
+		}
+	case opts.canonical:
+		records = canonicalRecords(records)
+	}
+	if len(dbs) > 0 && (opts.op != "" || opts.canonical) {
+		// merged prefixes are annotated again from their first address.
+		records = enrichRecords(records, dbs, geoFilter{})
+	}
+	if opts.count {
+		err = countRecords(out, records, opts)
+	} else {
+		var flush func() error
+		if opts.follow {
+			records = uniqueRecords(records)
+			flush = out.Flush
+		}
+		err = writeRecords(rw, records, flush)
+	}
+	if err != nil {
+		log.Println("failed to write the output -", err)
+		out.Flush()
+		os.Exit(1)
+	}
+
+	if ctx.Err() != nil && !opts.follow {
+		log.Println("interrupted - the output is incomplete")
+		out.Flush()
+		os.Exit(1)
+	}
+
+	if report != nil {
+		diag.summary(report)
+	}
+	if err := diag.strictFailure(); opts.strict && err != nil {
+		if report == nil {
+			diag.summary(os.Stderr)
+		}
+		log.Println(err)
+		out.Flush()
+		os.Exit(1)
+	}
 }
 
 /*
@@ -86,9 +378,176 @@ func main() {
 8.8.8.8
 8.8.8.8
 
-// Then run the program as below.
+// Then run the program as below. Each source is streamed line by line and up to -workers files
+// are read at the same time, so lines of different sources can be interleaved. Empty lines and
+// # comments are ignored.
+
+~$ cat ips.txt | go run . ips.txt
+127.0.0.1
+127.0.0.1
+127.0.0.1
+8.8.8.8
+127.0.0.1
+8.8.8.8
+8.8.8.8
+8.8.8.8
+
+// A line can be an address, a CIDR block or a dash range of either family. Blocks and ranges
+// are kept as prefixes - or expanded with the -expand flag.
+
+~$ printf "10.0.0.0/8\n192.168.1.10-192.168.1.17\n2001:db8::/126\n" | go run .
+10.0.0.0/8
+192.168.1.10/31
+192.168.1.12/30
+192.168.1.16/31
+2001:db8::/126
+
+~$ printf "10.0.0.0/8\n192.168.1.10-192.168.1.12\n" | go run . -expand -report -
+stdin:1: flagged "10.0.0.0/8": exceeds the expand limit of 256 addresses - kept as prefixes
+SOURCE                                     ACCEPTED   REJECTED    IGNORED    FLAGGED  ERROR
+stdin                                             2          0          0          1
+TOTAL                                             2          0          0          1
+10.0.0.0/8
+192.168.1.10
+192.168.1.11
+192.168.1.12
+
+// The canonical mode removes duplicates, sorts numerically and merges adjacent or overlapping
+// entries into the smallest list of prefixes.
+
+~$ cat ips.txt | go run . -canonical ips.txt ips.txt
+8.8.8.8
+127.0.0.1
+
+~$ printf "10.0.0.1\n10.0.0.0\n10.0.0.2-10.0.0.3\n10.0.0.0/30\n9.0.0.0/8\n::1\n" | go run . -canonical
+9.0.0.0/8
+10.0.0.0/30
+::1
+
+// Other output formats are selected with -format: plain lines, JSON, CSV, an ipset restore
+// script, an nftables set definition, iptables rules or a hosts.deny list.
+
+~$ printf "10.0.0.0/8\n2001:db8::1\n" | go run . -format ipset -set-name bad
+create bad hash:net family inet -exist
+create bad6 hash:net family inet6 -exist
+add bad 10.0.0.0/8 -exist
+add bad6 2001:db8::1 -exist
+
+~$ printf "10.0.0.0/8\n2001:db8::1\n" | go run . -format hosts.deny
+ALL: 10.0.0.0/255.0.0.0
+ALL: [2001:db8::1]
+
+// The extract mode finds addresses into logs or URLs, with a port, inside brackets or with a
+// zone. The JSON and CSV formats report the byte offset where each one was found.
+
+~$ printf "GET http://[2001:db8::1]:8080/x\nsrc=10.1.2.3:5353 dst=fe80::1%%eth0\n" | go run . -extract -format csv
+ip,category,country,asn,org,source,line,offset
+2001:db8::1,documentation,,,,stdin,1,12
+10.1.2.3,private,,,,stdin,2,36
+fe80::1%eth0,link-local,,,,stdin,2,54
+
+// Each entry is classified as public, loopback, private, link-local, multicast, documentation,
+// cgnat, bogon or mixed, and categories are filtered with -include or -exclude.
+
+~$ printf "127.0.0.1\n10.1.2.3\n100.64.0.1\n8.8.8.8\nfd00::1\n" | go run . -exclude loopback,private,cgnat
+8.8.8.8
+
+// Arguments named with name=path are grouped into sets and -op computes their union, intersection,
+// difference or symmetric difference from left to right. Piped entries, if any, form the leftmost
+// set. The parsing and the sets computations live into the importable ipset package.
+
+~$ printf "192.0.2.0/24\n" > block.txt; printf "192.0.2.0\n192.0.2.128/26\n" > allow.txt
+~$ go run . -op diff block=block.txt allow=allow.txt
+192.0.2.1
+192.0.2.2/31
+192.0.2.4/30
+192.0.2.8/29
+192.0.2.16/28
+192.0.2.32/27
+192.0.2.64/26
+192.0.2.192/26
+
+// Local MaxMind databases annotate the JSON and CSV outputs with the country, ASN and organisation
+// and allow filters with -country and -asn. A block is annotated from its first address.
+
+~$ printf "8.8.8.8\n1.1.1.1\n" | go run . -mmdb GeoLite2-Country.mmdb -mmdb GeoLite2-ASN.mmdb -country US -format csv
+ip,category,country,asn,org,source,line,offset
+8.8.8.8,public,US,15169,GOOGLE,stdin,1,0
+
+// Published feeds are fetched into -cache-dir and refreshed with conditional requests. The cached
+// copy is used when a download fails.
+
+~$ go run . -op diff block=https://example.com/blocklist.txt allow=allow.txt
+
+// Rejections and unreadable sources are reported with -report along with counts per source, and
+// the strict mode exits with a non-zero status on any of them or on any flagged entry.
+
+~$ printf "# feed\n10.0.0.1\n10.0.0.300\n" | go run . -report - -strict missing.txt
+stdin:3: rejected "10.0.0.300": ParseAddr("10.0.0.300"): IPv4 field has value >255
+missing.txt: unreadable source: open missing.txt: no such file or directory
+SOURCE                                     ACCEPTED   REJECTED    IGNORED    FLAGGED  ERROR
+stdin                                             1          1          1          0
+missing.txt                                       0          0          0          0  open missing.txt: no such file or directory
+TOTAL                                             1          1          1          0
+strict mode - 2 entries rejected or sources unreadable - 0 entries flagged
+10.0.0.1
+exit status 1
+
+// The follow mode watches the files like `tail -F`, surviving rotation and truncation, and streams
+// each new address once until the program is interrupted. Here from a growing log.
+
+~$ go run . -follow -extract /var/log/nginx/access.log | ./update-firewall.sh
+
+// Sources compressed with gzip, bzip2, zstd or xz are detected from their content, on the command
+// line or piped. The zstd and xz formats rely on the zstd and xz commands being installed.
+
+~$ cat access.log.1.gz | go run . -extract -canonical access.log.2.xz access.log.3.zst
+
+// The count mode shows which addresses and networks (-count-v4 and -count-v6) appear the most.
+// Blocks are only counted under prefixes. -histogram saves every count as CSV or JSON.
+
+~$ printf "10.0.0.1\n10.0.0.1\n10.0.0.2\n192.0.2.1\n" | go run . -top 2 -count -histogram counts.json
+4 entries - 3 distinct addresses - 2 distinct prefixes
+
+TOP 2 ADDRESSES
+RANK          COUNT   PERCENT  ENTRY
+1                 2    50.00%  10.0.0.1
+2                 1    25.00%  10.0.0.2
+
+TOP 2 PREFIXES (/24 and /64)
+RANK          COUNT   PERCENT  ENTRY
+1                 3    75.00%  10.0.0.0/24
+2                 1    25.00%  192.0.2.0/24
+
+// Addresses are written in their canonical form. -unmap turns IPv4-mapped IPv6 addresses into
+// IPv4 ones and -strip-zone drops zones. Octets with leading zeros are rejected as ambiguous
+// unless -leading-zeros decimal accepts them and flags them into the report.
+
+~$ printf "::ffff:1.2.3.4\n1.2.3.4\n2001:DB8::1\n2001:db8:0:0::1\nfe80::1%%eth0\n010.0.0.1\n" | go run . -unmap -leading-zeros decimal -report -
+stdin:6: flagged "010.0.0.1": leading zeros read as decimal: 10.0.0.1
+SOURCE                                     ACCEPTED   REJECTED    IGNORED    FLAGGED  ERROR
+stdin                                             6          0          0          1
+TOTAL                                             6          0          0          1
+1.2.3.4
+1.2.3.4
+2001:db8::1
+2001:db8::1
+fe80::1%eth0
+10.0.0.1
+
+// Directories, read recursively with -recursive, glob patterns and @listfiles are expanded by the
+// program. Symbolic links loops are reported.
+
+~$ go run . -extract -count -include-files '*.log' -exclude-files 'debug*' -recursive /var/log/nginx 'archives/**' @more-sources.txt
+
+// Serve the lists as a reputation lookup service. Local sources are checked every -reload-interval,
+// published feeds downloaded at most every -feed-interval, and the lists are replaced atomically
+// once fully loaded. GET /status shows the loaded version.
 
-~$ type ips.txt | go run load-ip-addresses.go ips.txt ips.txt
-[127.0.0.1 127.0.0.1 8.8.8.8 8.8.8.8 127.0.0.1 127.0.0.1 8.8.8.8 8.8.8.8 127.0.0.1 127.0.0.1 8.8.8.8 8.8.8.8]
+~$ go run . -serve :8080 -reload-interval 30s -feed-interval 6h tor=tor-exits.txt spam=https://www.spamhaus.org/drop/drop.txt
+~$ curl 'localhost:8080/check?ip=1.10.16.5'
+{"ip":"1.10.16.5","listed":true,"matches":[{"list":"spam","block":"1.10.16.0/20"}]}
+~$ curl -d '["1.10.16.5", "8.8.8.8"]' localhost:8080/check
+[{"ip":"1.10.16.5","listed":true,"matches":[{"list":"spam","block":"1.10.16.0/20"}]},{"ip":"8.8.8.8","listed":false}]
 
 */
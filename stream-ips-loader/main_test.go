@@ -0,0 +1,1278 @@
+package main
+
+// Basic test file for <stream-ips-loader> snippet.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetcher(t *testing.T) {
+	const feed = "10.0.0.0/8\n192.0.2.1\n"
+	var requests, notModified, failStatus atomic.Int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if code := failStatus.Load(); code != 0 {
+			w.WriteHeader(int(code))
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, feed)
+	}))
+	defer testServer.Close()
+
+	f := &fetcher{client: testServer.Client(), cacheDir: t.TempDir(), retries: 1, backoff: time.Millisecond}
+	url := testServer.URL + "/drop.txt"
+
+	read := func(t *testing.T) string {
+		t.Helper()
+		rc, err := f.fetch(url)
+		if err != nil {
+			t.Fatalf("fetch failed: %v", err)
+		}
+		defer rc.Close()
+		content, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		return string(content)
+	}
+
+	t.Run("first fetch downloads the feed", func(t *testing.T) {
+		if got := read(t); got != feed {
+			t.Errorf("expected %q but got %q", feed, got)
+		}
+		if requests.Load() != 1 {
+			t.Errorf("expected 1 request but got %d", requests.Load())
+		}
+	})
+
+	t.Run("second fetch is a conditional request", func(t *testing.T) {
+		if got := read(t); got != feed {
+			t.Errorf("expected %q but got %q", feed, got)
+		}
+		if notModified.Load() != 1 {
+			t.Errorf("expected a not modified response but got %d", notModified.Load())
+		}
+	})
+
+	t.Run("failed fetch falls back to the cache", func(t *testing.T) {
+		for code, want := range map[int32]int32{
+			http.StatusInternalServerError: 2,
+			http.StatusTooManyRequests:     2,
+			http.StatusNotFound:            1,
+			http.StatusForbidden:           1,
+		} {
+			failStatus.Store(code)
+			before := requests.Load()
+			if got := read(t); got != feed {
+				t.Errorf("%d: expected %q but got %q", code, feed, got)
+			}
+			if attempts := requests.Load() - before; attempts != want {
+				t.Errorf("%d: expected %d attempts but got %d", code, want, attempts)
+			}
+		}
+		failStatus.Store(http.StatusInternalServerError)
+	})
+
+	t.Run("failed fetch without cache is an error", func(t *testing.T) {
+		if _, err := f.fetch(testServer.URL + "/other.txt"); err == nil {
+			t.Error("expected an error but got nil")
+		}
+	})
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"*.log", "a.log", true},
+		{"*.log", "x/a.log", false},
+		{"**/*.log", "a.log", true},
+		{"**/*.log", "x/y/a.log", true},
+		{"x/**/b/*.gz", "x/b/a.gz", true},
+		{"x/**/b/*.gz", "x/y/z/b/a.gz", true},
+		{"x/**/b/*.gz", "x/y/a.gz", false},
+		{"**", "x/y/a.txt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			got := matchSegments(strings.Split(tt.pattern, "/"), strings.Split(tt.path, "/"))
+			if got != tt.want {
+				t.Errorf("expected %v but got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDiscoverInputs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"logs/a.log":              "",
+		"logs/b.txt":              "",
+		"logs/.hidden.log":        "",
+		"logs/c.log.old":          "",
+		"logs/sub/d.log":          "",
+		"logs/sub/deep/e.log":     "",
+		"lists/main.txt":          "# logs\n\n../logs/a.log\n@nested.txt\n",
+		"lists/nested.txt":        "../logs/sub/d.log\n@main.txt\n",
+		"lists/self.txt":          "@self.txt\n",
+		"lists/sub/relative.txt":  "../../logs/b.txt\n",
+		"lists/absolute.txt":      filepath.Join(dir, "logs", "sub") + "\n",
+		"lists/remote.txt":        "https://example.com/list.txt\n",
+		"lists/sub/with-glob.txt": "../../logs/sub/**/*.log\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a link to a parent directory makes a loop when walked recursively.
+	if err := os.Symlink(filepath.Join(dir, "logs"), filepath.Join(dir, "logs", "sub", "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		opts     options
+		expected []string
+		errs     []error
+	}{
+		{
+			name:     "directory",
+			args:     []string{"logs"},
+			expected: []string{"logs/.hidden.log", "logs/a.log", "logs/b.txt", "logs/c.log.old"},
+		},
+		{
+			name: "recursive directory",
+			args: []string{"logs"},
+			opts: options{recursive: true},
+			expected: []string{
+				"logs/.hidden.log", "logs/a.log", "logs/b.txt", "logs/c.log.old",
+				"logs/sub/d.log", "logs/sub/deep/e.log",
+			},
+			errs: []error{errSymlinkLoop},
+		},
+		{
+			name:     "include and exclude patterns",
+			args:     []string{"logs"},
+			opts:     options{recursive: true, includeFiles: "*.log, *.old", excludeFiles: ".*,c.*"},
+			expected: []string{"logs/a.log", "logs/sub/d.log", "logs/sub/deep/e.log"},
+			errs:     []error{errSymlinkLoop},
+		},
+		{
+			name:     "glob",
+			args:     []string{"logs/sub/*/*.log"},
+			expected: []string{"logs/sub/deep/e.log", "logs/sub/loop/.hidden.log", "logs/sub/loop/a.log"},
+		},
+		{
+			name:     "list files",
+			args:     []string{"@lists/sub/relative.txt", "@lists/absolute.txt", "@lists/remote.txt"},
+			expected: []string{"logs/b.txt", "logs/sub/d.log", "https://example.com/list.txt"},
+		},
+		{
+			name:     "list file with a glob",
+			args:     []string{"@lists/sub/with-glob.txt"},
+			expected: []string{"logs/sub/d.log", "logs/sub/deep/e.log", "logs/sub/loop/.hidden.log", "logs/sub/loop/a.log"},
+			errs:     []error{errSymlinkLoop},
+		},
+		{
+			name:     "list files including themselves",
+			args:     []string{"@lists/main.txt", "@lists/self.txt"},
+			expected: []string{"logs/a.log", "logs/sub/d.log"},
+			errs:     []error{errors.New("main.txt: list file includes itself"), errors.New("self.txt: list file includes itself")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inputs []input
+			for _, arg := range tt.args {
+				path := filepath.Join(dir, strings.TrimPrefix(arg, "@"))
+				if strings.HasPrefix(arg, "@") {
+					path = "@" + path
+				}
+				inputs = append(inputs, input{name: arg, path: path})
+			}
+			diag := newDiagnostics(nil)
+			var got []string
+			for _, in := range discoverInputs(inputs, tt.opts, diag) {
+				path := in.path
+				if rel, err := filepath.Rel(dir, path); err == nil && !isRemote(path) {
+					path = filepath.ToSlash(rel)
+				}
+				got = append(got, path)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v but got %v", tt.expected, got)
+			}
+			err := diag.sourceErrors()
+			for _, want := range tt.errs {
+				if !errors.Is(err, want) && (err == nil || !strings.Contains(err.Error(), want.Error())) {
+					t.Errorf("expected the error %v but got %v", want, err)
+				}
+			}
+			if len(tt.errs) == 0 && err != nil {
+				t.Errorf("expected no error but got %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractAddrs(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"GET http://[2001:db8::1]:8080/x", []string{"2001:db8::1@12"}},
+		{"src=10.1.2.3:5353", []string{"10.1.2.3@4"}},
+		{"1.2.3.4.5", nil},
+		{"v1.2.3.4", nil},
+		{"fe80::1%eth0", []string{"fe80::1%eth0@0"}},
+		{"GET http://[fe80::1%25eth0]/", []string{"fe80::1%eth0@12"}},
+		{"blocked 10.0.0.1.", []string{"10.0.0.1@8"}},
+		{"from 192.0.2.1 to 2001:db8::2, ok", []string{"192.0.2.1@5", "2001:db8::2@18"}},
+		{"10.0.0.1,10.0.0.2", []string{"10.0.0.1@0", "10.0.0.2@9"}},
+		{"version 1.2.3 of cafe", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			var got []string
+			for _, m := range extractAddrs(tt.text) {
+				got = append(got, fmt.Sprintf("%s@%d", m.addr, m.offset))
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("expected %v but got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		prefix, want string
+	}{
+		{"8.8.8.8/32", categoryPublic},
+		{"2606:4700::1111/128", categoryPublic},
+		{"127.0.0.1/32", categoryLoopback},
+		{"::1/128", categoryLoopback},
+		{"10.1.2.3/32", categoryPrivate},
+		{"172.31.255.255/32", categoryPrivate},
+		{"192.168.1.0/24", categoryPrivate},
+		{"fd00::1/128", categoryPrivate},
+		{"169.254.169.254/32", categoryLinkLocal},
+		{"fe80::1/128", categoryLinkLocal},
+		{"239.255.255.250/32", categoryMulticast},
+		{"ff02::1/128", categoryMulticast},
+		{"192.0.2.1/32", categoryDocumentation},
+		{"198.51.100.0/24", categoryDocumentation},
+		{"203.0.113.7/32", categoryDocumentation},
+		{"2001:db8::1/128", categoryDocumentation},
+		{"3fff::1/128", categoryDocumentation},
+		{"100.64.0.1/32", categoryCGNAT},
+		{"0.0.0.0/32", categoryBogon},
+		{"198.18.0.1/32", categoryBogon},
+		{"240.0.0.1/32", categoryBogon},
+		{"::/128", categoryBogon},
+		{"2001::1/128", categoryBogon},
+		{"172.15.255.255/32", categoryPublic},
+		{"172.32.0.0/32", categoryPublic},
+		{"10.0.0.0/7", categoryMixed},
+		{"192.0.0.0/16", categoryMixed},
+		{"0.0.0.0/0", categoryMixed},
+		{"2001:db8::/31", categoryMixed},
+		{"::ffff:10.1.2.3/128", categoryPrivate},
+		{"::ffff:8.8.8.8/128", categoryPublic},
+		{"::ffff:192.0.2.0/120", categoryDocumentation},
+		{"::ffff:0.0.0.0/96", categoryMixed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			if got := classify(netip.MustParsePrefix(tt.prefix)); got != tt.want {
+				t.Errorf("expected %s but got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSetRecords(t *testing.T) {
+	run := func(t *testing.T, op string, stdin []string, inputs []input, files map[string][]string) []string {
+		t.Helper()
+		records := make(chan record, 16)
+		for _, s := range stdin {
+			records <- record{prefix: netip.MustParsePrefix(s), input: stdinName}
+		}
+		for name, entries := range files {
+			for _, s := range entries {
+				records <- record{prefix: netip.MustParsePrefix(s), input: name}
+			}
+		}
+		close(records)
+		out, err := setRecords(records, inputs, op)
+		if err != nil {
+			t.Fatalf("setRecords failed: %v", err)
+		}
+		var got []string
+		for r := range out {
+			got = append(got, r.prefix.String())
+		}
+		return got
+	}
+	inputs := []input{{name: "block", path: "block.txt"}, {name: "allow", path: "allow.txt"}}
+	files := map[string][]string{"block": {"192.0.2.0/30"}, "allow": {"192.0.2.0/31"}}
+
+	t.Run("empty stdin is not an operand", func(t *testing.T) {
+		got := run(t, "diff", nil, inputs, files)
+		if want := "192.0.2.2/31"; strings.Join(got, " ") != want {
+			t.Errorf("expected %s but got %v", want, got)
+		}
+	})
+
+	t.Run("stdin is the leftmost set", func(t *testing.T) {
+		got := run(t, "diff", []string{"192.0.2.0/29"}, inputs, files)
+		if want := "192.0.2.4/30"; strings.Join(got, " ") != want {
+			t.Errorf("expected %s but got %v", want, got)
+		}
+	})
+
+	t.Run("no operands gives an empty set", func(t *testing.T) {
+		if got := run(t, "intersect", nil, nil, nil); len(got) != 0 {
+			t.Errorf("expected nothing but got %v", got)
+		}
+	})
+}
+
+func TestRecordWriters(t *testing.T) {
+	records := []record{
+		{prefix: netip.MustParsePrefix("192.0.2.1/32"), source: "list.txt", line: 1, offset: 0, category: "public", country: "US", asn: 15169, org: "GOOGLE"},
+		{prefix: netip.MustParsePrefix("198.51.100.0/22")},
+		{prefix: netip.MustParsePrefix("2001:db8::1/128"), zone: "eth0", source: "list.txt", line: 3, offset: 27},
+		{prefix: netip.MustParsePrefix("2001:db8:1::/48"), source: "list.txt", line: 4, offset: 44},
+	}
+	tests := map[string]string{
+		"plain": "192.0.2.1\n198.51.100.0/22\n2001:db8::1%eth0\n2001:db8:1::/48\n",
+		"json": `[
+  {"ip":"192.0.2.1","category":"public","country":"US","asn":15169,"org":"GOOGLE","source":"list.txt","line":1,"offset":0},
+  {"ip":"198.51.100.0/22"},
+  {"ip":"2001:db8::1%eth0","source":"list.txt","line":3,"offset":27},
+  {"ip":"2001:db8:1::/48","source":"list.txt","line":4,"offset":44}
+]
+`,
+		"csv": `ip,category,country,asn,org,source,line,offset
+192.0.2.1,public,US,15169,GOOGLE,list.txt,1,0
+198.51.100.0/22,,,,,,,
+2001:db8::1%eth0,,,,,list.txt,3,27
+2001:db8:1::/48,,,,,list.txt,4,44
+`,
+		"ipset": `create bad hash:net family inet -exist
+create bad6 hash:net family inet6 -exist
+add bad 192.0.2.1 -exist
+add bad 198.51.100.0/22 -exist
+add bad6 2001:db8::1 -exist
+add bad6 2001:db8:1::/48 -exist
+`,
+		"nft": "table inet filter {\n" +
+			"\tset bad {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t\tauto-merge\n" +
+			"\t\telements = {\n\t\t\t192.0.2.1,\n\t\t\t198.51.100.0/22\n\t\t}\n\t}\n" +
+			"\tset bad6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t\tauto-merge\n" +
+			"\t\telements = {\n\t\t\t2001:db8::1,\n\t\t\t2001:db8:1::/48\n\t\t}\n\t}\n" +
+			"}\n",
+		"iptables": `iptables -A BLOCK -s 192.0.2.1 -j DROP
+iptables -A BLOCK -s 198.51.100.0/22 -j DROP
+ip6tables -A BLOCK -s 2001:db8::1 -j DROP
+ip6tables -A BLOCK -s 2001:db8:1::/48 -j DROP
+`,
+		"hosts.deny": `ALL: 192.0.2.1
+ALL: 198.51.100.0/255.255.252.0
+ALL: [2001:db8::1]
+ALL: [2001:db8:1::]/48
+`,
+	}
+	if len(tests) != len(writers) {
+		t.Errorf("expected a test per format but got %d tests for %d formats", len(tests), len(writers))
+	}
+	for format, want := range tests {
+		t.Run(format, func(t *testing.T) {
+			var out bytes.Buffer
+			rw, err := newRecordWriter(format, &out, options{setName: "bad", chain: "BLOCK"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := rw.begin(); err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range records {
+				if err := rw.write(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := rw.end(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != want {
+				t.Errorf("expected\n%s\nbut got\n%s", want, out.String())
+			}
+		})
+	}
+
+	t.Run("empty nft sets", func(t *testing.T) {
+		var out bytes.Buffer
+		rw, _ := newRecordWriter("nft", &out, options{setName: "bad"})
+		rw.begin()
+		rw.end()
+		want := "table inet filter {\n" +
+			"\tset bad {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t\tauto-merge\n\t}\n" +
+			"\tset bad6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t\tauto-merge\n\t}\n" +
+			"}\n"
+		if out.String() != want {
+			t.Errorf("expected\n%s\nbut got\n%s", want, out.String())
+		}
+	})
+}
+
+func TestMMDBLookup(t *testing.T) {
+	types := map[string]any{
+		"utf8_string": "Kraków",
+		"double":      42.123456,
+		"float":       float32(1.1),
+		"bytes":       []byte{0, 0, 0, 42},
+		"uint16":      uint64(100),
+		"uint32":      uint64(1 << 28),
+		"uint64":      uint64(1 << 60),
+		"uint128":     new(big.Int).Lsh(big.NewInt(1), 120),
+		"int32":       int64(-1 << 28),
+		"boolean":     true,
+		"false":       false,
+		"array":       []any{uint64(1), uint64(2), uint64(3)},
+		"map": map[string]any{"mapX": map[string]any{
+			"arrayX":       []any{uint64(7), uint64(8), uint64(9)},
+			"utf8_stringX": "hello",
+		}},
+		"long_string": strings.Repeat("x", 300),
+	}
+	google := map[string]any{
+		"country":                        map[string]any{"iso_code": "US"},
+		"autonomous_system_number":       uint64(15169),
+		"autonomous_system_organization": "GOOGLE",
+	}
+	googleV6 := map[string]any{
+		"registered_country": map[string]any{"iso_code": "US"},
+		"organization":       "Google IPv6",
+	}
+	tests := []struct {
+		file, ip string
+		want     map[string]any
+	}{
+		{"test-ipv6-24.mmdb", "81.2.69.160", types},
+		{"test-ipv6-28.mmdb", "81.2.69.160", types},
+		{"test-ipv6-32.mmdb", "81.2.69.160", types},
+		{"test-ipv4-24.mmdb", "81.2.69.160", types},
+		{"test-ipv6-24.mmdb", "8.8.8.8", google},
+		{"test-ipv6-28.mmdb", "::ffff:8.8.4.4", nil},
+		{"test-ipv6-28.mmdb", "::ffff:8.8.8.4", google},
+		{"test-ipv4-24.mmdb", "8.8.8.255", google},
+		{"test-ipv6-32.mmdb", "2001:4860:4860::8888", googleV6},
+		{"test-ipv6-24.mmdb", "2001:4861::1", nil},
+		{"test-ipv4-24.mmdb", "2001:4860:4860::8888", nil},
+		{"test-ipv6-32.mmdb", "9.9.9.9", nil},
+		{"test-ipv4-24.mmdb", "1.1.2.1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file+" "+tt.ip, func(t *testing.T) {
+			db, err := openMMDB(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatalf("open failed: %v", err)
+			}
+			got, err := db.lookup(netip.MustParseAddr(tt.ip))
+			if err != nil {
+				t.Fatalf("lookup failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v but got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGeoLookup(t *testing.T) {
+	open := func(t *testing.T, files ...string) []*mmdbReader {
+		t.Helper()
+		var dbs []*mmdbReader
+		for _, file := range files {
+			db, err := openMMDB(filepath.Join("testdata", file))
+			if err != nil {
+				t.Fatalf("open failed: %v", err)
+			}
+			dbs = append(dbs, db)
+		}
+		return dbs
+	}
+	tests := []struct {
+		name  string
+		files []string
+		ip    string
+		want  geoInfo
+	}{
+		{"country and asn", []string{"test-ipv6-24.mmdb"}, "1.1.1.1", geoInfo{"AU", 13335, "CLOUDFLARENET"}},
+		{"country through a pointer", []string{"test-ipv6-28.mmdb"}, "8.8.8.8", geoInfo{"US", 15169, "GOOGLE"}},
+		{"registered country and organization", []string{"test-ipv6-32.mmdb"}, "2001:4860::1", geoInfo{"US", 0, "Google IPv6"}},
+		{"unknown address", []string{"test-ipv6-32.mmdb"}, "9.9.9.9", geoInfo{}},
+		{"next database fills the gaps", []string{"test-ipv4-24.mmdb", "test-ipv6-24.mmdb"}, "2001:4860::1", geoInfo{"US", 0, "Google IPv6"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := record{prefix: netip.PrefixFrom(netip.MustParseAddr(tt.ip), 32)}
+			if addr := netip.MustParseAddr(tt.ip); addr.Is6() {
+				r.prefix = netip.PrefixFrom(addr, 128)
+			}
+			if got := geoLookup(open(t, tt.files...), r); got != tt.want {
+				t.Errorf("expected %+v but got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGeoFilter(t *testing.T) {
+	tests := []struct {
+		name, countries, asns string
+		databases             int
+		fails                 bool
+	}{
+		{"no filter without database", "", "", 0, false},
+		{"country without database", "CN", "", 0, true},
+		{"asn without database", "", "AS15169", 0, true},
+		{"filters with database", "cn, us", "AS15169,13335", 1, false},
+		{"invalid asn", "", "ASX", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newGeoFilter(tt.countries, tt.asns, tt.databases)
+			if (err != nil) != tt.fails {
+				t.Errorf("expected failure %v but got %v", tt.fails, err)
+			}
+		})
+	}
+	f, _ := newGeoFilter("cn, us", "AS15169", 1)
+	if !f.keep(geoInfo{country: "US", asn: 15169}) || f.keep(geoInfo{country: "US", asn: 13335}) || f.keep(geoInfo{country: "FR", asn: 15169}) {
+		t.Error("unexpected filter result")
+	}
+}
+
+func TestMMDBDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		want error
+	}{
+		{"pointer to itself", []byte{0x20, 0x00}, errMMDBPointerChain},
+		{"pointer to a pointer", []byte{0x20, 0x02, 0x20, 0x00}, errMMDBPointerChain},
+		{"map containing itself", []byte{0xe1, 0x41, 'a', 0x20, 0x00}, errMMDBTooDeep},
+		{"truncated string", []byte{0x45, 'a', 'b'}, errMMDBTruncated},
+		{"pointer beyond the end", []byte{0x20, 0x10}, errMMDBTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := mmdbDecoder{buf: tt.buf}.decode(0)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("expected %v but got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestDecompression(t *testing.T) {
+	const content = "10.0.0.1\n# comment\n2001:db8::1\n"
+	const want = "10.0.0.1 2001:db8::1"
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, content)
+	zw.Close()
+	bz, err := os.ReadFile(filepath.Join("testdata", "ips.txt.bz2"))
+	if err != nil {
+		t.Fatalf("failed to read the bzip2 fixture: %v", err)
+	}
+
+	// load streams the given files and piped data, if not nil.
+	load := func(t *testing.T, piped []byte, paths ...string) string {
+		t.Helper()
+		stdin := os.Stdin
+		defer func() { os.Stdin = stdin }()
+		if piped == nil {
+			f, err := os.Open(os.DevNull)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			os.Stdin = f
+		} else {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			go func() {
+				w.Write(piped)
+				w.Close()
+			}()
+			os.Stdin = r
+		}
+		var inputs []input
+		for _, path := range paths {
+			inputs = append(inputs, input{name: path, path: path})
+		}
+		diag := newDiagnostics(nil)
+		var got []string
+		for r := range streamInfos(context.Background(), inputs, options{workers: 1}, diag) {
+			got = append(got, formatPrefix(r.prefix))
+		}
+		if err := diag.sourceErrors(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return strings.Join(got, " ")
+	}
+
+	dir := t.TempDir()
+	gzPath, bzPath := filepath.Join(dir, "ips.log"), filepath.Join(dir, "ips.1")
+	if err := os.WriteFile(gzPath, gz.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bzPath, bz, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("gzip file", func(t *testing.T) {
+		if got := load(t, nil, gzPath); got != want {
+			t.Errorf("expected %q but got %q", want, got)
+		}
+	})
+
+	t.Run("bzip2 file", func(t *testing.T) {
+		if got := load(t, nil, bzPath); got != want {
+			t.Errorf("expected %q but got %q", want, got)
+		}
+	})
+
+	t.Run("piped gzip", func(t *testing.T) {
+		if got := load(t, gz.Bytes()); got != want {
+			t.Errorf("expected %q but got %q", want, got)
+		}
+	})
+
+	t.Run("piped bzip2", func(t *testing.T) {
+		if got := load(t, bz); got != want {
+			t.Errorf("expected %q but got %q", want, got)
+		}
+	})
+
+	t.Run("uncompressed content is kept", func(t *testing.T) {
+		if got := load(t, []byte(content)); got != want {
+			t.Errorf("expected %q but got %q", want, got)
+		}
+	})
+
+	t.Run("missing decompressor", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir())
+		for _, c := range compressions {
+			if c.command == nil {
+				continue
+			}
+			_, name, err := decompress(bytes.NewReader(append(c.magic, 0, 0, 0)))
+			want := fmt.Sprintf("%s content requires the %s command", c.name, c.command[0])
+			if name != c.name || err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("expected %s error %q but got %v", name, want, err)
+			}
+		}
+	})
+}
+
+func TestCounter(t *testing.T) {
+	c, err := newCounter(24, 64)
+	if err != nil {
+		t.Fatalf("newCounter failed: %v", err)
+	}
+	for _, entry := range []string{
+		"10.0.0.2/32", "10.0.0.1/32", "10.0.0.2/32", "10.0.0.1/32", "10.0.0.200/32",
+		"2001:db8::1/128", "2001:db8::2/128", "2001:db8:0:1::1/128",
+		"10.0.0.16/28", "192.168.0.0/16",
+	} {
+		c.add(netip.MustParsePrefix(entry))
+	}
+	format := func(entries []countEntry) string {
+		var lines []string
+		for _, e := range entries {
+			lines = append(lines, fmt.Sprintf("%s=%d:%.0f", e.Key, e.Count, e.Percent))
+		}
+		return strings.Join(lines, " ")
+	}
+
+	t.Run("addresses ties are sorted by address", func(t *testing.T) {
+		want := "10.0.0.1=2:20 10.0.0.2=2:20 10.0.0.200=1:10 2001:db8::1=1:10 2001:db8::2=1:10 2001:db8:0:1::1=1:10"
+		if got := format(c.sortedCounts(c.addrs)); got != want {
+			t.Errorf("expected %s but got %s", want, got)
+		}
+	})
+
+	t.Run("prefixes aggregate by /24 and /64", func(t *testing.T) {
+		want := "10.0.0.0/24=6:60 2001:db8::/64=2:20 192.168.0.0/16=1:10 2001:db8:0:1::/64=1:10"
+		if got := format(c.sortedCounts(c.prefixes)); got != want {
+			t.Errorf("expected %s but got %s", want, got)
+		}
+	})
+
+	t.Run("report counts blocks under prefixes only", func(t *testing.T) {
+		var b strings.Builder
+		c.writeReport(&b, 1)
+		want := "10 entries - 6 distinct addresses - 4 distinct prefixes\n\n" +
+			"TOP 1 ADDRESSES\nRANK          COUNT   PERCENT  ENTRY\n1                 2    20.00%  10.0.0.1\n\n" +
+			"TOP 1 PREFIXES (/24 and /64)\nRANK          COUNT   PERCENT  ENTRY\n1                 6    60.00%  10.0.0.0/24\n"
+		if b.String() != want {
+			t.Errorf("expected %q but got %q", want, b.String())
+		}
+	})
+
+	t.Run("csv histogram", func(t *testing.T) {
+		var b strings.Builder
+		if err := c.writeHistogram(&b, "csv"); err != nil {
+			t.Fatalf("writeHistogram failed: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		if len(lines) != 11 || lines[0] != "kind,key,count,percent" || lines[1] != "address,10.0.0.1,2,20.0000" || lines[7] != "prefix,10.0.0.0/24,6,60.0000" {
+			t.Errorf("unexpected csv histogram %q", b.String())
+		}
+	})
+
+	t.Run("json histogram", func(t *testing.T) {
+		var b strings.Builder
+		if err := c.writeHistogram(&b, "json"); err != nil {
+			t.Fatalf("writeHistogram failed: %v", err)
+		}
+		var got struct {
+			Total     int          `json:"total"`
+			V4Bits    int          `json:"v4_prefix_length"`
+			V6Bits    int          `json:"v6_prefix_length"`
+			Addresses []countEntry `json:"addresses"`
+			Prefixes  []countEntry `json:"prefixes"`
+		}
+		if err := json.Unmarshal([]byte(b.String()), &got); err != nil {
+			t.Fatalf("invalid json histogram: %v", err)
+		}
+		if got.Total != 10 || got.V4Bits != 24 || got.V6Bits != 64 || len(got.Addresses) != 6 || len(got.Prefixes) != 4 {
+			t.Errorf("unexpected json histogram %s", b.String())
+		}
+		if got.Prefixes[0] != (countEntry{Key: "10.0.0.0/24", Count: 6, Percent: 60}) {
+			t.Errorf("unexpected top prefix %+v", got.Prefixes[0])
+		}
+	})
+}
+
+func TestStripLeadingZeros(t *testing.T) {
+	tests := []struct {
+		entry, want string
+		changed     bool
+	}{
+		{"10.0.0.1", "10.0.0.1", false},
+		{"010.001.002.003", "10.1.2.3", true},
+		{"10.0.0.01/32", "10.0.0.1/32", true},
+		{"10.0.0.000-10.0.0.009", "10.0.0.0-10.0.0.9", true},
+		{"::ffff:010.0.0.1", "::ffff:10.0.0.1", true},
+		{"::ffff:10.0.0.01", "::ffff:10.0.0.1", true},
+		{"2001:0db8::0001", "2001:0db8::0001", false},
+		{"::0001:0.0.0.1", "::0001:0.0.0.1", false},
+		{"fe80::1%eth0", "fe80::1%eth0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			got, changed := stripLeadingZeros(tt.entry)
+			if got != tt.want || changed != tt.changed {
+				t.Errorf("expected %q %v but got %q %v", tt.want, tt.changed, got, changed)
+			}
+		})
+	}
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		unmap  bool
+		want   string
+	}{
+		{"::ffff:1.2.3.4/128", true, "1.2.3.4/32"},
+		{"::ffff:1.2.3.0/120", true, "1.2.3.0/24"},
+		{"::ffff:0.0.0.0/96", true, "0.0.0.0/0"},
+		{"::ffff:1.2.3.4/128", false, "::ffff:1.2.3.4/128"},
+		{"::/64", true, "::/64"},
+		{"2001:db8::1/128", true, "2001:db8::1/128"},
+		{"1.2.3.4/32", true, "1.2.3.4/32"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %v", tt.prefix, tt.unmap), func(t *testing.T) {
+			if got := normalizePrefix(netip.MustParsePrefix(tt.prefix), tt.unmap); got.String() != tt.want {
+				t.Errorf("expected %s but got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLineHandler(t *testing.T) {
+	// handle parses the lines with opts and returns the written entries
+	// and the report.
+	handle := func(opts options, lines ...string) (string, string) {
+		var report strings.Builder
+		out := make(chan record, 16)
+		fn := lineHandler(context.Background(), input{name: "test", path: "test"}, opts, newDiagnostics(&report), out)
+		for i, line := range lines {
+			fn(i+1, 0, line, false)
+		}
+		close(out)
+		var got []string
+		for r := range out {
+			got = append(got, r.text())
+		}
+		return strings.Join(got, " "), report.String()
+	}
+	tests := []struct {
+		name         string
+		opts         options
+		lines        []string
+		want, report string
+	}{
+		{
+			name:  "canonical spelling",
+			opts:  options{leadingZeros: leadingZerosReject},
+			lines: []string{"2001:DB8:0:0::1", "::ffff:1.2.3.4", "fe80::1%eth0"},
+			want:  "2001:db8::1 ::ffff:1.2.3.4 fe80::1%eth0",
+		},
+		{
+			name:  "unmap and strip zone",
+			opts:  options{leadingZeros: leadingZerosReject, unmap: true, stripZone: true},
+			lines: []string{"::ffff:1.2.3.4", "::ffff:1.2.3.0/120", "fe80::1%eth0"},
+			want:  "1.2.3.4 1.2.3.0/24 fe80::1",
+		},
+		{
+			name:   "leading zeros rejected",
+			opts:   options{leadingZeros: leadingZerosReject},
+			lines:  []string{"010.0.0.1", "::ffff:010.0.0.1"},
+			report: "test:1: rejected \"010.0.0.1\": " + errLeadingZeros.Error() + "\ntest:2: rejected \"::ffff:010.0.0.1\": " + errLeadingZeros.Error() + "\n",
+		},
+		{
+			name:   "leading zeros read as decimal",
+			opts:   options{leadingZeros: leadingZerosDecimal, unmap: true},
+			lines:  []string{"::ffff:010.0.0.1"},
+			want:   "10.0.0.1",
+			report: "test:1: flagged \"::ffff:010.0.0.1\": leading zeros read as decimal: ::ffff:10.0.0.1\n",
+		},
+		{
+			name:   "expand limit is reported",
+			opts:   options{leadingZeros: leadingZerosReject, expand: true, expandLimit: 2},
+			lines:  []string{"10.0.0.0/30", "10.0.0.0/31"},
+			want:   "10.0.0.0/30 10.0.0.0 10.0.0.1",
+			report: "test:1: flagged \"10.0.0.0/30\": exceeds the expand limit of 2 addresses - kept as prefixes\n",
+		},
+		{
+			name:   "leading zeros rejected in extract mode",
+			opts:   options{leadingZeros: leadingZerosReject, extract: true},
+			lines:  []string{"src=010.0.0.1 dst=10.0.0.2"},
+			want:   "10.0.0.2",
+			report: "test:1: rejected \"010.0.0.1\": " + errLeadingZeros.Error() + "\n",
+		},
+		{
+			name:   "leading zeros flagged in extract mode",
+			opts:   options{leadingZeros: leadingZerosDecimal, extract: true},
+			lines:  []string{"src=010.0.0.1"},
+			want:   "10.0.0.1",
+			report: "test:1: flagged \"010.0.0.1\": leading zeros read as decimal: 10.0.0.1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, report := handle(tt.opts, tt.lines...)
+			if got != tt.want {
+				t.Errorf("expected entries %q but got %q", tt.want, got)
+			}
+			if report != tt.report {
+				t.Errorf("expected report %q but got %q", tt.report, report)
+			}
+		})
+	}
+
+	for _, extract := range []bool{false, true} {
+		t.Run(fmt.Sprintf("truncated line rejected with extract %v", extract), func(t *testing.T) {
+			var report strings.Builder
+			out := make(chan record, 16)
+			fn := lineHandler(context.Background(), input{name: "test", path: "test"}, options{leadingZeros: leadingZerosReject, extract: extract}, newDiagnostics(&report), out)
+			fn(1, 0, "10.0.0.1 10.0.0.2", true)
+			if len(out) != 0 {
+				t.Errorf("expected no entries but got %d", len(out))
+			}
+			if want := "test:1: rejected \"10.0.0.1 10.0.0.2\": " + errLineTooLong.Error() + "\n"; report.String() != want {
+				t.Errorf("expected report %q but got %q", want, report.String())
+			}
+		})
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	var report strings.Builder
+	diag := newDiagnostics(&report)
+	out := make(chan record, 16)
+	opts := options{leadingZeros: leadingZerosDecimal}
+	feed := "# feed\n10.0.0.1\n\n10.0.0.300\n010.0.0.2\n2001:db8::/32\n"
+	if err := parseLines(context.Background(), strings.NewReader(feed), input{name: "feed", path: "feed.txt"}, opts, diag, out); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseLines(context.Background(), strings.NewReader("not an ip\n192.0.2.1\n"), input{name: "more", path: "more.txt"}, opts, diag, out); err != nil {
+		t.Fatal(err)
+	}
+	diag.fail("missing.txt", os.ErrNotExist)
+	close(out)
+	if len(out) != 4 {
+		t.Errorf("expected 4 entries but got %d", len(out))
+	}
+
+	diag.summary(&report)
+	want := `feed.txt:4: rejected "10.0.0.300": ParseAddr("10.0.0.300"): IPv4 field has value >255
+feed.txt:5: flagged "010.0.0.2": leading zeros read as decimal: 10.0.0.2
+more.txt:1: rejected "not an ip": ParseAddr("not an ip"): unable to parse IP
+missing.txt: unreadable source: file does not exist
+SOURCE                                     ACCEPTED   REJECTED    IGNORED    FLAGGED  ERROR
+feed.txt                                          3          1          2          1
+more.txt                                          1          1          0          0
+missing.txt                                       0          0          0          0  file does not exist
+TOTAL                                             4          2          2          1
+`
+	if report.String() != want {
+		t.Errorf("expected report\n%s\nbut got\n%s", want, report.String())
+	}
+	err := diag.strictFailure()
+	if want := "strict mode - 3 entries rejected or sources unreadable - 1 entries flagged"; err == nil || err.Error() != want {
+		t.Errorf("expected %q but got %v", want, err)
+	}
+
+	clean := newDiagnostics(nil)
+	clean.accept("feed.txt")
+	clean.ignore("feed.txt")
+	if err := clean.strictFailure(); err != nil {
+		t.Errorf("expected no strict failure but got %v", err)
+	}
+	flagged := newDiagnostics(nil)
+	flagged.flag("feed.txt", 1, "010.0.0.2", "leading zeros read as decimal: 10.0.0.2")
+	if err := flagged.strictFailure(); err == nil {
+		t.Error("expected a strict failure on a flagged entry")
+	}
+}
+
+func TestFollowInput(t *testing.T) {
+	// follow tails path until the end of the test and returns its records.
+	follow := func(t *testing.T, path string) <-chan record {
+		ctx, cancel := context.WithCancel(context.Background())
+		out := make(chan record, 16)
+		go func() {
+			followInput(ctx, input{name: "test", path: path}, options{followInterval: 5 * time.Millisecond, leadingZeros: leadingZerosReject}, newDiagnostics(nil), out)
+			close(out)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			for range out {
+			}
+		})
+		return out
+	}
+	expect := func(t *testing.T, out <-chan record, want ...string) {
+		t.Helper()
+		for _, w := range want {
+			select {
+			case r := <-out:
+				if r.text() != w {
+					t.Fatalf("expected %s but got %s", w, r.text())
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("expected %s but got nothing", w)
+			}
+		}
+	}
+	write := func(t *testing.T, path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// writeAt overwrites the start of path in place, without truncating it.
+	writeAt := func(t *testing.T, path, content string) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("appended lines", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ips.log")
+		write(t, path, "1.1.1.1\n")
+		out := follow(t, path)
+		expect(t, out, "1.1.1.1")
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		f.WriteString("2.2.2.2\n3.3.3")
+		expect(t, out, "2.2.2.2")
+		f.WriteString(".3\r\n")
+		expect(t, out, "3.3.3.3")
+	})
+
+	t.Run("missing at start", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ips.log")
+		out := follow(t, path)
+		write(t, path, "1.1.1.1\n")
+		expect(t, out, "1.1.1.1")
+	})
+
+	t.Run("rotated", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ips.log")
+		write(t, path, "1.1.1.1\n")
+		out := follow(t, path)
+		expect(t, out, "1.1.1.1")
+		if err := os.Rename(path, path+".1"); err != nil {
+			t.Fatal(err)
+		}
+		write(t, path, "2.2.2.2\n")
+		expect(t, out, "2.2.2.2")
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ips.log")
+		write(t, path, "1.1.1.1\n2.2.2.2\n")
+		out := follow(t, path)
+		expect(t, out, "1.1.1.1", "2.2.2.2")
+		write(t, path, "3.3.3.3\n")
+		expect(t, out, "3.3.3.3")
+	})
+
+	t.Run("rewritten larger", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ips.log")
+		write(t, path, "1.1.1.1\n")
+		out := follow(t, path)
+		expect(t, out, "1.1.1.1")
+		writeAt(t, path, "4.4.4.4\n5.5.5.5\n")
+		expect(t, out, "4.4.4.4", "5.5.5.5")
+	})
+
+	t.Run("rewritten with the same size", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ips.log")
+		write(t, path, "1.1.1.1\n")
+		out := follow(t, path)
+		expect(t, out, "1.1.1.1")
+		writeAt(t, path, "4.4.4.4\n")
+		// the modification time may not change on filesystems with a coarse
+		// timestamps resolution.
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, out, "4.4.4.4")
+	})
+}
+
+func TestUniqueRecords(t *testing.T) {
+	records := make(chan record, 8)
+	for _, s := range []string{"1.1.1.1", "fe80::1%eth0", "1.1.1.1", "fe80::1%eth1", "10.0.0.0/8", "fe80::1%eth0", "10.0.0.0/8"} {
+		a, zone, _ := strings.Cut(s, "%")
+		p, err := netip.ParsePrefix(a)
+		if err != nil {
+			p = netip.PrefixFrom(netip.MustParseAddr(a), 128)
+			if !strings.Contains(a, ":") {
+				p = netip.PrefixFrom(netip.MustParseAddr(a), 32)
+			}
+		}
+		records <- record{prefix: p, zone: zone}
+	}
+	close(records)
+	var got []string
+	for r := range uniqueRecords(records) {
+		got = append(got, r.text())
+	}
+	if want := "1.1.1.1 fe80::1%eth0 fe80::1%eth1 10.0.0.0/8"; strings.Join(got, " ") != want {
+		t.Errorf("expected %s but got %v", want, got)
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	long := strings.Repeat("x", maxLineSize+10)
+	tests := []struct {
+		name, content string
+		want          []string
+	}{
+		{"lf endings", "a\nbb\n", []string{"1@0:a", "2@2:bb"}},
+		{"crlf endings", "a\r\nbb\r\n", []string{"1@0:a", "2@3:bb"}},
+		{"missing final newline", "a\nbb", []string{"1@0:a", "2@2:bb"}},
+		{"empty lines", "\n\na\n", []string{"1@0:", "2@1:", "3@2:a"}},
+		{"too long line", "a\n" + long + "\nb\n", []string{"1@0:a", fmt.Sprintf("2@2:%d truncated", maxLineSize), fmt.Sprintf("3@%d:b", maxLineSize+13)}},
+		{"too long last line", long, []string{fmt.Sprintf("1@0:%d truncated", maxLineSize)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := readLines(strings.NewReader(tt.content), func(line int, offset int64, text string, truncated bool) {
+				if truncated {
+					text = fmt.Sprintf("%d truncated", len(text))
+				}
+				got = append(got, fmt.Sprintf("%d@%d:%s", line, offset, text))
+			})
+			if err != nil {
+				t.Fatalf("readLines failed: %v", err)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("expected %v but got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReputationServer(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(list, []byte("10.0.0.0/24\n10.0.1.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := newReputationServer([]string{"bad=" + list}, options{workers: 1, serve: ":0"}, categoryFilter{})
+	if _, err := srv.load(true); err != nil {
+		t.Fatalf("failed to load the lists: %v", err)
+	}
+	testServer := httptest.NewServer(srv.handler())
+	defer testServer.Close()
+
+	t.Run("listed address", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "/check?ip=10.0.1.7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res checkResult
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.Listed || len(res.Matches) != 1 || res.Matches[0] != (listMatch{List: "bad", Block: "10.0.0.0/23"}) {
+			t.Errorf("unexpected result %+v", res)
+		}
+	})
+
+	t.Run("batch lookup", func(t *testing.T) {
+		resp, err := http.Post(testServer.URL+"/check", "application/json", strings.NewReader(`["8.8.8.8", "nope"]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var results []checkResult
+		if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || results[0].Listed || results[1].Error == "" {
+			t.Errorf("unexpected results %+v", results)
+		}
+	})
+
+	t.Run("whole address space", func(t *testing.T) {
+		all := filepath.Join(t.TempDir(), "all.txt")
+		if err := os.WriteFile(all, []byte("::/0\n0.0.0.0/0\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		srv := newReputationServer([]string{"all=" + all}, options{workers: 1, serve: ":0"}, categoryFilter{})
+		if _, err := srv.load(true); err != nil {
+			t.Fatalf("failed to load the lists: %v", err)
+		}
+		rec := httptest.NewRecorder()
+		srv.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/check?ip=::1", nil))
+		var res checkResult
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.Listed || len(res.Matches) != 1 || res.Matches[0] != (listMatch{List: "all", Block: "::/0"}) {
+			t.Errorf("unexpected result %+v", res)
+		}
+		rec = httptest.NewRecorder()
+		srv.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `{"name":"all","prefixes":2}`) {
+			t.Errorf("unexpected status %d %s", rec.Code, rec.Body.String())
+		}
+	})
+
+	t.Run("reload on change", func(t *testing.T) {
+		if err := os.WriteFile(list, []byte("8.8.8.8\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		reloaded, err := srv.load(false)
+		if err != nil || !reloaded {
+			t.Fatalf("expected a reload but got %v, %v", reloaded, err)
+		}
+		if res := srv.current.Load().check("8.8.8.8"); !res.Listed {
+			t.Error("expected 8.8.8.8 to be listed after the reload")
+		}
+	})
+
+	t.Run("remote feeds are downloaded once per feed interval", func(t *testing.T) {
+		var requests atomic.Int32
+		feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			io.WriteString(w, "192.0.2.0/24\n")
+		}))
+		defer feed.Close()
+
+		opts := options{workers: 1, serve: ":0", cacheDir: t.TempDir(), feedInterval: time.Hour}
+		srv := newReputationServer([]string{"spam=" + feed.URL + "/drop.txt"}, opts, categoryFilter{})
+		if _, err := srv.load(true); err != nil {
+			t.Fatalf("failed to load the lists: %v", err)
+		}
+		if res := srv.current.Load().check("192.0.2.1"); !res.Listed {
+			t.Error("expected 192.0.2.1 to be listed")
+		}
+		if reloaded, err := srv.load(false); err != nil || reloaded {
+			t.Errorf("expected no reload but got %v, %v", reloaded, err)
+		}
+		if n := requests.Load(); n != 1 {
+			t.Errorf("expected 1 request but got %d", n)
+		}
+
+		srv.opts.feedInterval = 0
+		if reloaded, err := srv.load(false); err != nil || reloaded {
+			t.Errorf("expected no reload of an unchanged feed but got %v, %v", reloaded, err)
+		}
+		if n := requests.Load(); n != 2 {
+			t.Errorf("expected 2 requests but got %d", n)
+		}
+	})
+}
@@ -0,0 +1,355 @@
+package main
+
+// This file contains a minimal reader of MaxMind DB (.mmdb) files such as the
+// GeoLite2 Country, City and ASN databases. It follows the format specification
+// at https://maxmind.github.io/MaxMind-DB/ and never does any network lookup.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+)
+
+// mmdbMetadataMarker starts the metadata section at the end of the file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdb data types.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// mmdbReader looks up addresses into a MaxMind DB file loaded in memory.
+// It is safe for concurrent use once opened.
+type mmdbReader struct {
+	path       string
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dbType     string
+	// dataStart is the position of the data section into buf.
+	dataStart uint
+	// ipv4Start is the node where IPv4 lookups start into an IPv6 tree.
+	ipv4Start uint
+}
+
+// openMMDB loads the database file at path.
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pos := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if pos < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+	metaStart := uint(pos + len(mmdbMetadataMarker))
+	d := mmdbDecoder{buf: buf[metaStart:]}
+	value, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid metadata: %w", path, err)
+	}
+	meta, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid metadata", path)
+	}
+
+	db := &mmdbReader{path: path, buf: buf}
+	db.nodeCount = uint(toUint64(meta["node_count"]))
+	db.recordSize = uint(toUint64(meta["record_size"]))
+	db.ipVersion = uint(toUint64(meta["ip_version"]))
+	db.dbType, _ = meta["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	db.dataStart = treeSize + 16
+	if db.dataStart > metaStart {
+		return nil, fmt.Errorf("%s: corrupted search tree", path)
+	}
+
+	if db.ipVersion == 6 {
+		// IPv4 addresses are stored under ::/96.
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.readRecord(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// readRecord returns the left (bit 0) or right (bit 1) record of a node.
+func (db *mmdbReader) readRecord(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		b := db.buf[off : off+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		off := node * 7
+		b := db.buf[off : off+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(db.buf[off : off+4]))
+	}
+}
+
+// lookup returns the data stored for the address or nil when the address
+// is not into the database.
+func (db *mmdbReader) lookup(addr netip.Addr) (map[string]any, error) {
+	addr = addr.Unmap()
+	var ip []byte
+	node := uint(0)
+	if addr.Is4() {
+		b := addr.As4()
+		ip = b[:]
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else {
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+		b := addr.As16()
+		ip = b[:]
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.readRecord(node, bit)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("invalid search tree")
+	}
+
+	offset := node - db.nodeCount - 16
+	d := mmdbDecoder{buf: db.buf[db.dataStart:]}
+	value, _, err := d.decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := value.(map[string]any)
+	return data, nil
+}
+
+// mmdbDecoder decodes the values of a data or metadata section. Pointers
+// are offsets from the start of buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// maxMMDBDepth is the maximum nesting of maps and arrays, which stops a
+// corrupted file from looping through pointers to its own containers.
+const maxMMDBDepth = 512
+
+var (
+	// errMMDBTruncated is returned when a value goes beyond the section end.
+	errMMDBTruncated = errors.New("truncated data")
+	// errMMDBPointerChain is returned by a pointer to another pointer, which
+	// the format does not allow.
+	errMMDBPointerChain = errors.New("pointer to a pointer")
+	// errMMDBTooDeep is returned when values are nested beyond maxMMDBDepth.
+	errMMDBTooDeep = errors.New("data nested too deeply")
+)
+
+// bytesAt returns n bytes from offset.
+func (d mmdbDecoder) bytesAt(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) || offset+n < offset {
+		return nil, errMMDBTruncated
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// uintFrom returns the big-endian unsigned integer stored into b.
+func uintFrom(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// decodeControl reads a control byte and returns the type, the size and
+// the offset of the payload.
+func (d mmdbDecoder) decodeControl(offset uint) (int, uint, uint, error) {
+	b, err := d.bytesAt(offset, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := int(ctrl >> 5)
+	if typ == mmdbExtended {
+		if b, err = d.bytesAt(offset, 1); err != nil {
+			return 0, 0, 0, err
+		}
+		typ = 7 + int(b[0])
+		offset++
+	}
+	if typ == mmdbPointer {
+		return typ, uint(ctrl & 0x1f), offset, nil
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if b, err = d.bytesAt(offset, n); err != nil {
+			return 0, 0, 0, err
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + uint(uintFrom(b))
+		case 30:
+			size = 285 + uint(uintFrom(b))
+		default:
+			size = 65821 + uint(uintFrom(b))
+		}
+	}
+	return typ, size, offset, nil
+}
+
+// decode returns the value at offset and the offset following it.
+func (d mmdbDecoder) decode(offset uint) (any, uint, error) {
+	return d.decodeAt(offset, 0)
+}
+
+// decodeAt decodes the value at offset, nested into depth containers.
+func (d mmdbDecoder) decodeAt(offset uint, depth int) (any, uint, error) {
+	if depth > maxMMDBDepth {
+		return nil, 0, errMMDBTooDeep
+	}
+	typ, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case mmdbPointer:
+		n := (size>>3)&0x3 + 1
+		b, err := d.bytesAt(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		var target uint
+		switch n {
+		case 1:
+			target = (size&0x7)<<8 | uint(b[0])
+		case 2:
+			target = ((size&0x7)<<16 | uint(uintFrom(b))) + 2048
+		case 3:
+			target = ((size&0x7)<<24 | uint(uintFrom(b))) + 526336
+		default:
+			target = uint(uintFrom(b))
+		}
+		if targetType, _, _, err := d.decodeControl(target); err != nil {
+			return nil, 0, err
+		} else if targetType == mmdbPointer {
+			return nil, 0, errMMDBPointerChain
+		}
+		// the value pointed to is returned but decoding goes on after the pointer.
+		value, _, err := d.decodeAt(target, depth)
+		return value, offset + n, err
+	case mmdbString:
+		b, err := d.bytesAt(offset, size)
+		return string(b), offset + size, err
+	case mmdbBytes:
+		b, err := d.bytesAt(offset, size)
+		return bytes.Clone(b), offset + size, err
+	case mmdbDouble:
+		b, err := d.bytesAt(offset, 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset + 8, nil
+	case mmdbFloat:
+		b, err := d.bytesAt(offset, 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset + 4, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		b, err := d.bytesAt(offset, size)
+		if err != nil || size > 8 {
+			return nil, 0, errors.Join(err, errors.New("invalid unsigned integer"))
+		}
+		return uintFrom(b), offset + size, nil
+	case mmdbInt32:
+		b, err := d.bytesAt(offset, size)
+		if err != nil || size > 4 {
+			return nil, 0, errors.Join(err, errors.New("invalid signed integer"))
+		}
+		// values shorter than 4 bytes are always positive.
+		return int64(int32(uint32(uintFrom(b)))), offset + size, nil
+	case mmdbUint128:
+		b, err := d.bytesAt(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return new(big.Int).SetBytes(b), offset + size, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			var key, value any
+			if key, offset, err = d.decodeAt(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			if value, offset, err = d.decodeAt(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value any
+			if value, offset, err = d.decodeAt(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+// toUint64 converts a decoded unsigned integer, returning 0 for other types.
+func toUint64(v any) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
@@ -0,0 +1,105 @@
+package main
+
+// This file contains the normalisation of the addresses spellings. Addresses are
+// always written in their canonical form (RFC 5952 for IPv6), and options convert
+// IPv4-mapped IPv6 addresses, strip the zones and handle the leading zero octets
+// that some legacy parsers read as octal numbers.
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// leading zero octets policies.
+const (
+	leadingZerosReject  = "reject"
+	leadingZerosDecimal = "decimal"
+)
+
+// errLeadingZeros is the reason of rejection of IPv4 addresses with leading
+// zero octets, which are decimal for some parsers and octal for others.
+var errLeadingZeros = errors.New("ambiguous IPv4 octet with leading zero - decimal or octal")
+
+// isDigit reports whether c is a decimal digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// stripLeadingZeros removes the leading zeros of the IPv4 octets found into
+// entry, like 010.001.002.003, 10.0.0.01/32 or ::ffff:010.0.0.1, and reports
+// whether any was removed. IPv6 groups are left untouched since leading zeros are valid there.
+func stripLeadingZeros(entry string) (string, bool) {
+	var b strings.Builder
+	changed := false
+	for i := 0; i < len(entry); {
+		if !isDigit(entry[i]) || (i > 0 && isHexDigit(entry[i-1])) {
+			b.WriteByte(entry[i])
+			i++
+			continue
+		}
+		end := i
+		for end < len(entry) && isDigit(entry[end]) {
+			end++
+		}
+		// only octets of a dotted address are concerned, not IPv6 groups like 0db8.
+		dotted := (end < len(entry) && entry[end] == '.') || (i > 0 && entry[i-1] == '.')
+		if end < len(entry) && isHexDigit(entry[end]) {
+			dotted = false
+		}
+		// after a colon only the first octet of an embedded IPv4 address
+		// like ::ffff:010.0.0.1 is concerned.
+		if i > 0 && entry[i-1] == ':' && (end == len(entry) || entry[end] != '.') {
+			dotted = false
+		}
+		number := entry[i:end]
+		if dotted && len(number) > 1 && number[0] == '0' {
+			number = strings.TrimLeft(number, "0")
+			if number == "" {
+				number = "0"
+			}
+			changed = true
+		}
+		b.WriteString(number)
+		i = end
+	}
+	return b.String(), changed
+}
+
+// normalizePrefix converts an IPv4-mapped IPv6 prefix into its IPv4
+// counterpart when unmap is set.
+func normalizePrefix(p netip.Prefix, unmap bool) netip.Prefix {
+	if unmap && p.Addr().Is4In6() && p.Bits() >= 96 {
+		return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p
+}
+
+// entryZone returns the zone of an entry made of a single IPv6 address.
+func entryZone(entry string) string {
+	if strings.ContainsAny(entry, "/-") {
+		return ""
+	}
+	a, err := netip.ParseAddr(entry)
+	if err != nil {
+		return ""
+	}
+	return a.Zone()
+}
+
+// text returns the canonical form of the record entry, zone included.
+func (r record) text() string {
+	if r.zone != "" && r.prefix.IsSingleIP() {
+		return r.prefix.Addr().WithZone(r.zone).String()
+	}
+	return formatPrefix(r.prefix)
+}
+
+// checkLeadingZeros validates the -leading-zeros policy.
+func checkLeadingZeros(policy string) error {
+	if policy != leadingZerosReject && policy != leadingZerosDecimal {
+		return fmt.Errorf("unknown leading zeros policy %q - expected %s or %s", policy, leadingZerosReject, leadingZerosDecimal)
+	}
+	return nil
+}
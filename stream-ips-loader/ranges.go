@@ -0,0 +1,51 @@
+package main
+
+// This file contains the expand mode and the display of prefixes.
+
+import (
+	"net/netip"
+
+	"github.com/jeamon/gosnippets/stream-ips-loader/ipset"
+)
+
+// prefixesSize returns the number of addresses covered by the prefixes
+// or -1 if that number is greater than limit.
+func prefixesSize(prefixes []netip.Prefix, limit int) int {
+	total := 0
+	for _, p := range prefixes {
+		host := p.Addr().BitLen() - p.Bits()
+		if host >= 62 {
+			return -1
+		}
+		total += 1 << host
+		if total > limit {
+			return -1
+		}
+	}
+	return total
+}
+
+// expandPrefixes returns each single address covered by the prefixes.
+// Callers must check the size with prefixesSize first.
+func expandPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	var hosts []netip.Prefix
+	for _, p := range prefixes {
+		last := ipset.LastAddr(p)
+		for a := p.Addr(); ; a = a.Next() {
+			hosts = append(hosts, ipset.HostPrefix(a))
+			if a == last {
+				break
+			}
+		}
+	}
+	return hosts
+}
+
+// formatPrefix returns a prefix in its shortest form: a single address is
+// displayed without its length and a block keeps the CIDR notation.
+func formatPrefix(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
@@ -0,0 +1,299 @@
+package main
+
+// This file contains the server mode which keeps the lists in memory and answers
+// reputation lookups over HTTP. The lists are loaded with the same logic as the
+// other modes, checked for changes periodically and replaced atomically so a
+// lookup always sees a complete generation of the lists.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeamon/gosnippets/stream-ips-loader/ipset"
+)
+
+const (
+	// maxBatchSize is the maximum number of addresses of a batch lookup.
+	maxBatchSize = 10000
+	// maxBatchBody is the maximum size in bytes of a batch lookup request.
+	maxBatchBody = 1 << 20
+)
+
+// namedSet is a loaded list.
+type namedSet struct {
+	name string
+	set  *ipset.Set
+}
+
+// reputation is a generation of the loaded lists. It is never modified once
+// published so it can be read without locking.
+type reputation struct {
+	lists    []namedSet
+	version  int
+	loadedAt time.Time
+	// state is the fingerprint of the sources this generation comes from.
+	state string
+}
+
+// listMatch is a list containing a looked up address. Block is the block of
+// the merged list which contains the address, it may span several entries
+// of the list source.
+type listMatch struct {
+	List  string `json:"list"`
+	Block string `json:"block"`
+}
+
+// checkResult is the answer to the lookup of a single address.
+type checkResult struct {
+	IP      string      `json:"ip"`
+	Listed  bool        `json:"listed"`
+	Matches []listMatch `json:"matches,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// check looks up the address in every list.
+func (rep *reputation) check(ip string) checkResult {
+	res := checkResult{IP: ip}
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		res.Error = "invalid IP address"
+		return res
+	}
+	addr = addr.WithZone("")
+	for _, l := range rep.lists {
+		if p, found := l.set.Lookup(addr); found {
+			res.Matches = append(res.Matches, listMatch{List: l.name, Block: formatPrefix(p)})
+		}
+	}
+	res.Listed = len(res.Matches) > 0
+	return res
+}
+
+// reputationServer loads the lists and serves the lookups.
+type reputationServer struct {
+	opts   options
+	args   []string
+	filter categoryFilter
+	remote *fetcher
+	// fetchedAt holds when each remote feed was last fetched. It is only
+	// used by load, which never runs concurrently.
+	fetchedAt map[string]time.Time
+	// current holds the *reputation in use.
+	current atomic.Pointer[reputation]
+}
+
+// newReputationServer returns a server of the lists given as arguments. Each
+// argument is a list on its own unless gathered with the name=path syntax.
+func newReputationServer(args []string, opts options, filter categoryFilter) *reputationServer {
+	return &reputationServer{opts: opts, args: args, filter: filter, remote: newFetcher(opts), fetchedAt: make(map[string]time.Time)}
+}
+
+// refresh fetches the remote inputs not fetched for opts.feedInterval and
+// returns the inputs with each remote feed replaced by its cached copy, so
+// a feed is downloaded once per refresh and read from the disk afterwards.
+func (srv *reputationServer) refresh(inputs []input) ([]input, error) {
+	local := make([]input, 0, len(inputs))
+	for _, in := range inputs {
+		if !isRemote(in.path) {
+			local = append(local, in)
+			continue
+		}
+		dataPath, _ := srv.remote.cachePaths(in.path)
+		if time.Since(srv.fetchedAt[in.path]) >= srv.opts.feedInterval {
+			f, err := srv.remote.fetch(in.path)
+			if err != nil {
+				return nil, err
+			}
+			f.Close()
+			srv.fetchedAt[in.path] = time.Now()
+		}
+		local = append(local, input{name: in.name, path: dataPath})
+	}
+	return local, nil
+}
+
+// fingerprint returns a summary of the state of the sources which changes
+// when a file is modified, added or removed.
+func (srv *reputationServer) fingerprint(inputs []input) string {
+	var b strings.Builder
+	for _, in := range inputs {
+		fmt.Fprintf(&b, "%s=%s", in.name, in.path)
+		if fi, err := os.Stat(in.path); err == nil {
+			fmt.Fprintf(&b, ":%d:%d", fi.Size(), fi.ModTime().UnixNano())
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// load builds a new generation of the lists when the sources changed since
+// the current one. It reports whether the lists were replaced. The current
+// lists are kept if any source cannot be read.
+func (srv *reputationServer) load(force bool) (bool, error) {
+	diag := newDiagnostics(nil)
+	inputs := discoverInputs(parseInputs(srv.args), srv.opts, diag)
+	if err := diag.sourceErrors(); err != nil {
+		return false, err
+	}
+	inputs, err := srv.refresh(inputs)
+	if err != nil {
+		return false, err
+	}
+	prev := srv.current.Load()
+	state := srv.fingerprint(inputs)
+	if !force && prev != nil && prev.state == state {
+		return false, nil
+	}
+
+	var names []string
+	builders := make(map[string]*ipset.Builder)
+	for _, in := range inputs {
+		if _, found := builders[in.name]; !found {
+			names = append(names, in.name)
+			builders[in.name] = &ipset.Builder{}
+		}
+	}
+	for r := range classifyRecords(streamInfos(context.Background(), inputs, srv.opts, diag), srv.filter) {
+		builders[r.input].Add(r.prefix)
+	}
+	if err := diag.sourceErrors(); err != nil {
+		return false, err
+	}
+	if n := diag.failures(); n > 0 {
+		log.Printf("%d invalid entries ignored while loading the lists\n", n)
+	}
+
+	rep := &reputation{version: 1, loadedAt: time.Now().UTC(), state: state}
+	if prev != nil {
+		rep.version = prev.version + 1
+	}
+	for _, name := range names {
+		rep.lists = append(rep.lists, namedSet{name: name, set: builders[name].Set()})
+	}
+	srv.current.Store(rep)
+	return true, nil
+}
+
+// watch checks the sources every interval and loads the lists again when
+// they changed, until ctx is done.
+func (srv *reputationServer) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := srv.load(false)
+		switch {
+		case err != nil:
+			log.Printf("failed to reload the lists - keeping version %d - %v\n", srv.current.Load().version, err)
+		case reloaded:
+			log.Printf("lists reloaded - version %d\n", srv.current.Load().version)
+		}
+	}
+}
+
+// writeJSON writes v as the JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleCheck serves GET /check?ip=... for a single address and POST /check
+// with a JSON array of addresses for a batch.
+func (srv *reputationServer) handleCheck(w http.ResponseWriter, r *http.Request) {
+	rep := srv.current.Load()
+	switch r.Method {
+	case http.MethodGet:
+		res := rep.check(r.URL.Query().Get("ip"))
+		if res.Error != "" {
+			writeJSON(w, http.StatusBadRequest, res)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	case http.MethodPost:
+		var ips []string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&ips); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected a JSON array of IP addresses - " + err.Error()})
+			return
+		}
+		if len(ips) > maxBatchSize {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("at most %d addresses per batch", maxBatchSize)})
+			return
+		}
+		results := make([]checkResult, len(ips))
+		for i, ip := range ips {
+			results[i] = rep.check(ip)
+		}
+		writeJSON(w, http.StatusOK, results)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// listStatus describes a loaded list.
+type listStatus struct {
+	Name     string `json:"name"`
+	Prefixes int    `json:"prefixes"`
+}
+
+// handleStatus serves GET /status with the version and content of the lists.
+func (srv *reputationServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	rep := srv.current.Load()
+	status := struct {
+		Version  int          `json:"version"`
+		LoadedAt time.Time    `json:"loaded_at"`
+		Lists    []listStatus `json:"lists"`
+	}{Version: rep.version, LoadedAt: rep.loadedAt}
+	for _, l := range rep.lists {
+		status.Lists = append(status.Lists, listStatus{Name: l.name, Prefixes: len(l.set.Prefixes())})
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handler returns the routes of the server.
+func (srv *reputationServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/check", srv.handleCheck)
+	mux.HandleFunc("/status", srv.handleStatus)
+	return mux
+}
+
+// serve loads the lists then serves the lookups on addr until ctx is done.
+func (srv *reputationServer) serve(ctx context.Context, addr string, interval time.Duration) error {
+	if _, err := srv.load(true); err != nil {
+		return fmt.Errorf("failed to load the lists: %w", err)
+	}
+	rep := srv.current.Load()
+	names := make([]string, 0, len(rep.lists))
+	for _, l := range rep.lists {
+		names = append(names, l.name)
+	}
+	log.Printf("serving the lists %s on %s\n", strings.Join(names, ", "), addr)
+
+	go srv.watch(ctx, interval)
+	server := &http.Server{Addr: addr, Handler: srv.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+// This file contains the set algebra between named inputs. Each input is turned
+// into an ipset.Set and the operations are computed on its sorted disjoint ranges,
+// so a /24 minus a /32 gives back the exact remaining prefixes.
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jeamon/gosnippets/stream-ips-loader/ipset"
+)
+
+// input is a source of entries and the name of the set it belongs to.
+type input struct {
+	name string
+	path string
+}
+
+// inputNameRegex matches the name part of a name=path argument.
+var inputNameRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// parseInputs builds the inputs from the program arguments. An argument can
+// be a plain path, which forms a set on its own, or name=path to gather
+// several files into the same named set.
+func parseInputs(args []string) []input {
+	inputs := make([]input, 0, len(args))
+	for _, arg := range args {
+		if name, path, found := strings.Cut(arg, "="); found && inputNameRegex.MatchString(name) && path != "" {
+			inputs = append(inputs, input{name: name, path: path})
+			continue
+		}
+		inputs = append(inputs, input{name: arg, path: arg})
+	}
+	return inputs
+}
+
+// setOperation computes a new set from two others.
+type setOperation func(a, b *ipset.Set) *ipset.Set
+
+// setOperations maps the names accepted by -op to their operation.
+var setOperations = map[string]setOperation{
+	"union":     (*ipset.Set).Union,
+	"intersect": (*ipset.Set).Intersect,
+	"diff":      (*ipset.Set).Difference,
+	"symdiff":   (*ipset.Set).SymmetricDifference,
+}
+
+// operationNames returns the sorted list of supported set operations.
+func operationNames() []string {
+	names := make([]string, 0, len(setOperations))
+	for name := range setOperations {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// setRecords gathers the records of each named set and returns a channel of
+// the canonical result of applying the operation from left to right over the
+// sets, in the order they first appear on the command line. The piped data is
+// the leftmost set, but only when it held entries, so an empty stdin left open
+// by a cron job or a container does not become an operand.
+func setRecords(records <-chan record, inputs []input, op string) (<-chan record, error) {
+	operation, found := setOperations[op]
+	if !found {
+		return nil, fmt.Errorf("unknown set operation %q - expected one of %s", op, strings.Join(operationNames(), ", "))
+	}
+
+	var names []string
+	builders := make(map[string]*ipset.Builder, len(inputs)+1)
+	for _, in := range inputs {
+		if _, found := builders[in.name]; !found {
+			names = append(names, in.name)
+			builders[in.name] = &ipset.Builder{}
+		}
+	}
+	for r := range records {
+		b, found := builders[r.input]
+		if !found {
+			b = &ipset.Builder{}
+			builders[r.input] = b
+		}
+		b.Add(r.prefix)
+	}
+	if _, found := builders[stdinName]; found && !slices.Contains(names, stdinName) {
+		names = append([]string{stdinName}, names...)
+	}
+
+	result := (&ipset.Builder{}).Set()
+	for i, name := range names {
+		set := builders[name].Set()
+		if i == 0 {
+			result = set
+			continue
+		}
+		result = operation(result, set)
+	}
+
+	prefixes := result.Prefixes()
+	out := make(chan record, len(prefixes))
+	for _, p := range prefixes {
+		out <- record{prefix: p, category: classify(p)}
+	}
+	close(out)
+	return out, nil
+}
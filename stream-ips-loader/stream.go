@@ -0,0 +1,333 @@
+package main
+
+// This file contains the streaming ingestion: every source is read line by line
+// and each valid entry is sent on a channel as soon as it is parsed. Memory use
+// only depends on the longest accepted line and the channel buffer size.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jeamon/gosnippets/stream-ips-loader/ipset"
+)
+
+// maxLineSize is the longest line accepted. The rest of longer lines is dropped.
+const maxLineSize = 64 * 1024
+
+// stdinName is the source name used for data piped to the program.
+const stdinName = "stdin"
+
+// record is a valid entry loaded from a source.
+type record struct {
+	prefix netip.Prefix
+	// zone is the zone of a single IPv6 address, if any.
+	zone   string
+	source string
+	// input is the name of the set the source belongs to.
+	input string
+	line  int
+	// offset is the byte position of the entry from the start of the source.
+	offset int64
+	// category is the addresses category of the entry.
+	category string
+	// country, asn and org come from the MaxMind databases, if any.
+	country string
+	asn     uint64
+	org     string
+}
+
+// errLineTooLong is the reason of rejection of lines longer than maxLineSize.
+var errLineTooLong = fmt.Errorf("line longer than %d bytes", maxLineSize)
+
+// readLines reads r line by line and calls fn with each line number, the byte
+// offset of the line start and the line content without its ending. Both "\n"
+// and "\r\n" endings are supported. Lines longer than maxLineSize are truncated
+// so the memory use stays bounded, and fn is told so.
+func readLines(r io.Reader, fn func(line int, offset int64, text string, truncated bool)) error {
+	br := bufio.NewReaderSize(r, maxLineSize)
+	var offset int64
+	for n := 1; ; n++ {
+		data, err := br.ReadSlice('\n')
+		if len(data) == 0 && err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		size := int64(len(data))
+		text := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+		// skip what remains of a too long line.
+		truncated := errors.Is(err, bufio.ErrBufferFull)
+		for errors.Is(err, bufio.ErrBufferFull) {
+			data, err = br.ReadSlice('\n')
+			size += int64(len(data))
+		}
+		fn(n, offset, text, truncated)
+		offset += size
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// isIgnored reports whether a trimmed line is empty or a comment.
+func isIgnored(entry string) bool {
+	return entry == "" || strings.HasPrefix(entry, "#")
+}
+
+// ctxReader stops reading once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// parseLines reads all lines of r and sends the valid entries on out,
+// until ctx is done.
+func parseLines(ctx context.Context, r io.Reader, in input, opts options, diag *diagnostics, out chan<- record) error {
+	return readLines(ctxReader{ctx: ctx, r: r}, lineHandler(ctx, in, opts, diag, out))
+}
+
+// lineHandler returns the function which parses each line of a source and
+// sends its valid entries on out. In extract mode the addresses are searched
+// everywhere into each line, otherwise a line must be a single entry. Empty
+// lines and comments starting with # are ignored, other invalid lines are rejected.
+// Nothing is sent anymore once ctx is done.
+func lineHandler(ctx context.Context, in input, opts options, diag *diagnostics, out chan<- record) func(line int, offset int64, text string, truncated bool) {
+	source := in.path
+	return func(line int, offset int64, text string, truncated bool) {
+		// a truncated line is rejected in both modes: its end is lost and
+		// its last address may be cut.
+		if truncated {
+			diag.reject(source, line, strings.TrimSpace(text), errLineTooLong)
+			return
+		}
+		if opts.extract {
+			matches := extractAddrs(text)
+			if len(matches) == 0 {
+				diag.ignore(source)
+				return
+			}
+			kept := matches[:0]
+			for _, m := range matches {
+				if m.leadingZeros {
+					if opts.leadingZeros == leadingZerosReject {
+						diag.reject(source, line, m.text, errLeadingZeros)
+						continue
+					}
+					diag.flag(source, line, m.text, fmt.Sprintf("leading zeros read as decimal: %s", m.addr))
+				}
+				kept = append(kept, m)
+			}
+			if len(kept) == 0 {
+				return
+			}
+			diag.accept(source)
+			for _, m := range kept {
+				r := record{
+					prefix: normalizePrefix(ipset.HostPrefix(m.addr), opts.unmap),
+					source: source,
+					input:  in.name,
+					line:   line,
+					offset: offset + int64(m.offset),
+				}
+				if !opts.stripZone {
+					r.zone = m.addr.Zone()
+				}
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+			return
+		}
+
+		entry := strings.TrimSpace(text)
+		if isIgnored(entry) {
+			diag.ignore(source)
+			return
+		}
+		offset += int64(strings.Index(text, entry))
+		if fixed, changed := stripLeadingZeros(entry); changed {
+			if opts.leadingZeros == leadingZerosReject {
+				diag.reject(source, line, entry, errLeadingZeros)
+				return
+			}
+			diag.flag(source, line, entry, fmt.Sprintf("leading zeros read as decimal: %s", fixed))
+			entry = fixed
+		}
+		prefixes, err := ipset.ParseEntry(entry)
+		if err != nil {
+			diag.reject(source, line, entry, err)
+			return
+		}
+		diag.accept(source)
+		zone := ""
+		if !opts.stripZone {
+			zone = entryZone(entry)
+		}
+		if opts.expand {
+			if prefixesSize(prefixes, opts.expandLimit) < 0 {
+				diag.flag(source, line, entry, fmt.Sprintf("exceeds the expand limit of %d addresses - kept as prefixes", opts.expandLimit))
+			} else {
+				prefixes = expandPrefixes(prefixes)
+			}
+		}
+		for _, p := range prefixes {
+			r := record{prefix: normalizePrefix(p, opts.unmap), zone: zone, source: source, input: in.name, line: line, offset: offset}
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// isPiped reports whether some data is piped to the program.
+func isPiped() (bool, error) {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false, err
+	}
+	return (fi.Mode() & os.ModeCharDevice) == 0, nil
+}
+
+// openInput opens a local file or fetches a remote http(s) source.
+func openInput(in input, remote *fetcher) (io.ReadCloser, error) {
+	if isRemote(in.path) {
+		return remote.fetch(in.path)
+	}
+	return os.Open(in.path)
+}
+
+// isCompressedFile reports whether the file at path holds compressed data.
+// Such files are read once, even in follow mode.
+func isCompressedFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 8)
+	n, _ := io.ReadFull(f, head)
+	return detectCompression(head[:n]) != nil
+}
+
+// streamInfos reads the piped data and the inputs concurrently, with a pool
+// of opts.workers goroutines reading the files, and sends each valid entry on the
+// returned channel. Entries of a given source keep their order but sources
+// are interleaved. The channel is closed once every source is fully read.
+// Rejected lines and unreadable sources are reported to diag. In follow mode
+// local files are watched until ctx is done, each in its own goroutine.
+func streamInfos(ctx context.Context, inputs []input, opts options, diag *diagnostics) <-chan record {
+	out := make(chan record, 1024)
+	workers := opts.workers
+	if workers < 1 {
+		workers = 1
+	}
+	remote := newFetcher(opts)
+	var wg sync.WaitGroup
+
+	piped, err := isPiped()
+	if err != nil {
+		diag.fail(stdinName, err)
+	}
+	// the server mode loads its sources again on change, which a pipe cannot do.
+	if piped && opts.serve == "" {
+		// a pipe can stay open without sending anything and closing it does
+		// not unblock its reader, so the piped entries go through their own
+		// channel which is no longer waited for once ctx is done.
+		stdin := make(chan record, cap(out))
+		go func() {
+			defer close(stdin)
+			if err := parseCompressed(ctx, os.Stdin, input{name: stdinName, path: stdinName}, opts, diag, stdin); err != nil && ctx.Err() == nil {
+				diag.fail(stdinName, err)
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case r, ok := <-stdin:
+					if !ok {
+						return
+					}
+					select {
+					case out <- r:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// a fixed pool of workers reads the files so that the number of
+	// goroutines does not grow with the number of inputs.
+	jobs := make(chan input)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for in := range jobs {
+				f, err := openInput(in, remote)
+				if err != nil {
+					diag.fail(in.path, err)
+					continue
+				}
+				if err := parseCompressed(ctx, f, in, opts, diag, out); err != nil && ctx.Err() == nil {
+					diag.fail(in.path, err)
+				}
+				f.Close()
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for _, in := range inputs {
+			if opts.follow && !isRemote(in.path) && !isCompressedFile(in.path) {
+				wg.Add(1)
+				go func(in input) {
+					defer wg.Done()
+					followInput(ctx, in, opts, diag, out)
+				}(in)
+				continue
+			}
+			select {
+			case jobs <- in:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
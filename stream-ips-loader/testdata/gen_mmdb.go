@@ -0,0 +1,282 @@
+//go:build ignore
+
+// This program generates the small MaxMind DB files used by the tests of the
+// mmdb reader. Run it from the snippet folder with: go run testdata/gen_mmdb.go
+//
+// Each database holds the same networks and covers every data type along with
+// one and four bytes pointers. IPv6 trees store IPv4 networks under ::/96.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/netip"
+	"os"
+	"path/filepath"
+)
+
+type (
+	kv struct {
+		key   string
+		value any
+	}
+	omap    []kv
+	u16     uint16
+	u32     uint32
+	u64     uint64
+	i32     int32
+	f32     float32
+	pointer struct {
+		target int
+		wide   bool
+	}
+)
+
+// encoder builds a data section.
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) control(typ, size int) {
+	var extra []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		extra = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		extra = binary.BigEndian.AppendUint16(nil, uint16(size-285))
+		size = 30
+	default:
+		extra = binary.BigEndian.AppendUint32(nil, uint32(size-65821))[1:]
+		size = 31
+	}
+	if typ < 8 {
+		e.buf.WriteByte(byte(typ<<5 | size))
+	} else {
+		e.buf.WriteByte(byte(size))
+		e.buf.WriteByte(byte(typ - 7))
+	}
+	e.buf.Write(extra)
+}
+
+// minimal returns v as big-endian bytes without leading zeros.
+func minimal(v uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, v)
+	return bytes.TrimLeft(b, "\x00")
+}
+
+// write appends v to the data section and returns its offset.
+func (e *encoder) write(v any) int {
+	offset := e.buf.Len()
+	switch v := v.(type) {
+	case pointer:
+		if v.wide {
+			e.buf.WriteByte(1<<5 | 3<<3)
+			e.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(v.target)))
+		} else {
+			e.buf.WriteByte(byte(1<<5 | v.target>>8))
+			e.buf.WriteByte(byte(v.target))
+		}
+	case string:
+		e.control(2, len(v))
+		e.buf.WriteString(v)
+	case float64:
+		e.control(3, 8)
+		e.buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+	case []byte:
+		e.control(4, len(v))
+		e.buf.Write(v)
+	case u16:
+		b := minimal(uint64(v))
+		e.control(5, len(b))
+		e.buf.Write(b)
+	case u32:
+		b := minimal(uint64(v))
+		e.control(6, len(b))
+		e.buf.Write(b)
+	case omap:
+		e.control(7, len(v))
+		for _, item := range v {
+			e.write(item.key)
+			e.write(item.value)
+		}
+	case i32:
+		e.control(8, 4)
+		e.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(v)))
+	case u64:
+		b := minimal(uint64(v))
+		e.control(9, len(b))
+		e.buf.Write(b)
+	case *big.Int:
+		e.control(10, len(v.Bytes()))
+		e.buf.Write(v.Bytes())
+	case []any:
+		e.control(11, len(v))
+		for _, item := range v {
+			e.write(item)
+		}
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		e.control(14, size)
+	case f32:
+		e.control(15, 4)
+		e.buf.Write(binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(v))))
+	default:
+		log.Fatalf("unsupported value %T", v)
+	}
+	return offset
+}
+
+// node is a node of the search tree. A child is either another node, the
+// offset of its data or nothing.
+type node struct {
+	children [2]*node
+	data     [2]int
+	index    int
+}
+
+// insert stores the data offset for the network p into the tree.
+func insert(root *node, p netip.Prefix, ipVersion int, data int) {
+	ip := p.Addr().AsSlice()
+	bits := p.Bits()
+	if ipVersion == 6 && p.Addr().Is4() {
+		ip = append(make([]byte, 12), ip...)
+		bits += 96
+	}
+	n := root
+	for i := 0; i < bits; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if i == bits-1 {
+			n.data[bit] = data + 1
+			return
+		}
+		if n.children[bit] == nil {
+			n.children[bit] = &node{}
+		}
+		n = n.children[bit]
+	}
+}
+
+// generate writes the database with the given ip version and record size.
+func generate(path string, ipVersion, recordSize int) error {
+	var data encoder
+	us := data.write(omap{{"iso_code", "US"}})
+	networks := []struct {
+		prefix string
+		data   omap
+	}{
+		{"1.1.1.0/24", omap{
+			{"country", omap{{"iso_code", "AU"}}},
+			{"autonomous_system_number", u32(13335)},
+			{"autonomous_system_organization", "CLOUDFLARENET"},
+		}},
+		{"8.8.8.0/24", omap{
+			{"country", pointer{target: us}},
+			{"autonomous_system_number", u32(15169)},
+			{"autonomous_system_organization", "GOOGLE"},
+		}},
+		{"2001:4860::/32", omap{
+			{"registered_country", pointer{target: us, wide: true}},
+			{"organization", "Google IPv6"},
+		}},
+		{"81.2.69.0/24", omap{
+			{"utf8_string", "Kraków"},
+			{"double", 42.123456},
+			{"float", f32(1.1)},
+			{"bytes", []byte{0, 0, 0, 42}},
+			{"uint16", u16(100)},
+			{"uint32", u32(1 << 28)},
+			{"uint64", u64(1 << 60)},
+			{"uint128", new(big.Int).Lsh(big.NewInt(1), 120)},
+			{"int32", i32(-1 << 28)},
+			{"boolean", true},
+			{"false", false},
+			{"array", []any{u32(1), u32(2), u32(3)}},
+			{"map", omap{{"mapX", omap{{"arrayX", []any{u32(7), u32(8), u32(9)}}, {"utf8_stringX", "hello"}}}}},
+			{"long_string", string(bytes.Repeat([]byte("x"), 300))},
+		}},
+	}
+
+	root := &node{}
+	for _, network := range networks {
+		p := netip.MustParsePrefix(network.prefix)
+		if ipVersion == 4 && !p.Addr().Is4() {
+			continue
+		}
+		insert(root, p, ipVersion, data.write(network.data))
+	}
+
+	// nodes are numbered breadth first.
+	nodes := []*node{root}
+	for i := 0; i < len(nodes); i++ {
+		nodes[i].index = i
+		for _, child := range nodes[i].children {
+			if child != nil {
+				nodes = append(nodes, child)
+			}
+		}
+	}
+	nodeCount := len(nodes)
+	record := func(n *node, bit int) uint32 {
+		switch {
+		case n.children[bit] != nil:
+			return uint32(n.children[bit].index)
+		case n.data[bit] != 0:
+			return uint32(nodeCount + 16 + n.data[bit] - 1)
+		}
+		return uint32(nodeCount)
+	}
+
+	var out bytes.Buffer
+	for _, n := range nodes {
+		left, right := record(n, 0), record(n, 1)
+		switch recordSize {
+		case 24:
+			out.Write(binary.BigEndian.AppendUint32(nil, left)[1:])
+			out.Write(binary.BigEndian.AppendUint32(nil, right)[1:])
+		case 28:
+			out.Write(binary.BigEndian.AppendUint32(nil, left)[1:])
+			out.WriteByte(byte(left>>24)<<4 | byte(right>>24)&0x0f)
+			out.Write(binary.BigEndian.AppendUint32(nil, right)[1:])
+		default:
+			out.Write(binary.BigEndian.AppendUint32(nil, left))
+			out.Write(binary.BigEndian.AppendUint32(nil, right))
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.buf.Bytes())
+
+	var meta encoder
+	meta.write(omap{
+		{"node_count", u32(nodeCount)},
+		{"record_size", u16(recordSize)},
+		{"ip_version", u16(ipVersion)},
+		{"database_type", "Test"},
+		{"languages", []any{"en"}},
+		{"binary_format_major_version", u16(2)},
+		{"binary_format_minor_version", u16(0)},
+		{"build_epoch", u64(1700000000)},
+		{"description", omap{{"en", "stream-ips-loader test database"}}},
+	})
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	out.Write(meta.buf.Bytes())
+	return os.WriteFile(path, out.Bytes(), 0o644)
+}
+
+func main() {
+	for _, db := range []struct{ ipVersion, recordSize int }{{6, 24}, {6, 28}, {6, 32}, {4, 24}} {
+		path := filepath.Join("testdata", fmt.Sprintf("test-ipv%d-%d.mmdb", db.ipVersion, db.recordSize))
+		if err := generate(path, db.ipVersion, db.recordSize); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
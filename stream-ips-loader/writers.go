@@ -0,0 +1,283 @@
+package main
+
+// This file contains the output formats. Each format is a recordWriter built by
+// a factory registered into the writers map under the name given to -format.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// recordWriter writes loaded records into a given output format.
+type recordWriter interface {
+	// begin writes what must come before the first record.
+	begin() error
+	// write writes a single record.
+	write(r record) error
+	// end writes what must come after the last record.
+	end() error
+}
+
+// writerFactory builds a recordWriter which outputs to w.
+type writerFactory func(w io.Writer, opts options) recordWriter
+
+// writers maps each supported format name to its factory.
+var writers = map[string]writerFactory{
+	"plain":      func(w io.Writer, opts options) recordWriter { return &plainWriter{w: w} },
+	"json":       func(w io.Writer, opts options) recordWriter { return &jsonWriter{w: w} },
+	"csv":        func(w io.Writer, opts options) recordWriter { return &csvWriter{w: csv.NewWriter(w)} },
+	"ipset":      func(w io.Writer, opts options) recordWriter { return &ipsetWriter{w: w, name: opts.setName} },
+	"nft":        func(w io.Writer, opts options) recordWriter { return &nftWriter{w: w, name: opts.setName} },
+	"iptables":   func(w io.Writer, opts options) recordWriter { return &iptablesWriter{w: w, chain: opts.chain} },
+	"hosts.deny": func(w io.Writer, opts options) recordWriter { return &hostsDenyWriter{w: w} },
+}
+
+// formatNames returns the sorted list of supported formats.
+func formatNames() []string {
+	names := make([]string, 0, len(writers))
+	for name := range writers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// newRecordWriter returns the writer of the named format.
+func newRecordWriter(format string, w io.Writer, opts options) (recordWriter, error) {
+	factory, found := writers[format]
+	if !found {
+		return nil, fmt.Errorf("unknown output format %q - expected one of %s", format, strings.Join(formatNames(), ", "))
+	}
+	return factory(w, opts), nil
+}
+
+// plainWriter writes one entry per line.
+type plainWriter struct {
+	w io.Writer
+}
+
+func (pw *plainWriter) begin() error { return nil }
+
+func (pw *plainWriter) write(r record) error {
+	_, err := fmt.Fprintln(pw.w, r.text())
+	return err
+}
+
+func (pw *plainWriter) end() error { return nil }
+
+// jsonRecord is the representation of a record in JSON outputs.
+type jsonRecord struct {
+	IP       string `json:"ip"`
+	Category string `json:"category,omitempty"`
+	Country  string `json:"country,omitempty"`
+	ASN      uint64 `json:"asn,omitempty"`
+	Org      string `json:"org,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Offset   *int64 `json:"offset,omitempty"`
+}
+
+// newJSONRecord returns the JSON representation of r. Records built from
+// several sources, like the canonical ones, have no source nor offset.
+func newJSONRecord(r record) jsonRecord {
+	jr := jsonRecord{
+		IP:       r.text(),
+		Category: r.category,
+		Country:  r.country,
+		ASN:      r.asn,
+		Org:      r.org,
+		Source:   r.source,
+		Line:     r.line,
+	}
+	if r.source != "" {
+		jr.Offset = &r.offset
+	}
+	return jr
+}
+
+// jsonWriter writes a JSON array of objects, one object per line.
+type jsonWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (jw *jsonWriter) begin() error {
+	_, err := io.WriteString(jw.w, "[")
+	return err
+}
+
+func (jw *jsonWriter) write(r record) error {
+	data, err := json.Marshal(newJSONRecord(r))
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if jw.count == 0 {
+		sep = "\n"
+	}
+	jw.count++
+	_, err = fmt.Fprintf(jw.w, "%s  %s", sep, data)
+	return err
+}
+
+func (jw *jsonWriter) end() error {
+	_, err := io.WriteString(jw.w, "\n]\n")
+	return err
+}
+
+// csvWriter writes a CSV document with a header line.
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvWriter) begin() error {
+	return cw.w.Write([]string{"ip", "category", "country", "asn", "org", "source", "line", "offset"})
+}
+
+func (cw *csvWriter) write(r record) error {
+	asn, line, offset := "", "", ""
+	if r.asn != 0 {
+		asn = strconv.FormatUint(r.asn, 10)
+	}
+	if r.source != "" {
+		line, offset = strconv.Itoa(r.line), strconv.FormatInt(r.offset, 10)
+	}
+	return cw.w.Write([]string{r.text(), r.category, r.country, asn, r.org, r.source, line, offset})
+}
+
+func (cw *csvWriter) end() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// ipsetWriter writes an `ipset restore` script. IPv4 entries go into the set
+// named after -set-name and IPv6 entries into the same name suffixed by 6.
+type ipsetWriter struct {
+	w    io.Writer
+	name string
+}
+
+func (iw *ipsetWriter) begin() error {
+	_, err := fmt.Fprintf(iw.w, "create %s hash:net family inet -exist\ncreate %s6 hash:net family inet6 -exist\n", iw.name, iw.name)
+	return err
+}
+
+func (iw *ipsetWriter) write(r record) error {
+	name := iw.name
+	if !r.prefix.Addr().Is4() {
+		name += "6"
+	}
+	_, err := fmt.Fprintf(iw.w, "add %s %s -exist\n", name, formatPrefix(r.prefix))
+	return err
+}
+
+func (iw *ipsetWriter) end() error { return nil }
+
+// nftWriter writes an nftables table definition holding two interval sets,
+// one per family, to be loaded with `nft -f`. A set definition lists all its
+// elements at once so they are kept in memory until the end.
+type nftWriter struct {
+	w          io.Writer
+	name       string
+	v4Elements []string
+	v6Elements []string
+}
+
+func (nw *nftWriter) begin() error { return nil }
+
+func (nw *nftWriter) write(r record) error {
+	if r.prefix.Addr().Is4() {
+		nw.v4Elements = append(nw.v4Elements, formatPrefix(r.prefix))
+	} else {
+		nw.v6Elements = append(nw.v6Elements, formatPrefix(r.prefix))
+	}
+	return nil
+}
+
+// writeSet writes a single set definition. nftables refuses an empty
+// elements list so it is omitted for an empty set.
+func (nw *nftWriter) writeSet(name, addrType string, elements []string) error {
+	_, err := fmt.Fprintf(nw.w, "\tset %s {\n\t\ttype %s\n\t\tflags interval\n\t\tauto-merge\n", name, addrType)
+	if err != nil {
+		return err
+	}
+	if len(elements) > 0 {
+		_, err = fmt.Fprintf(nw.w, "\t\telements = {\n\t\t\t%s\n\t\t}\n", strings.Join(elements, ",\n\t\t\t"))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(nw.w, "\t}\n")
+	return err
+}
+
+func (nw *nftWriter) end() error {
+	if _, err := io.WriteString(nw.w, "table inet filter {\n"); err != nil {
+		return err
+	}
+	if err := nw.writeSet(nw.name, "ipv4_addr", nw.v4Elements); err != nil {
+		return err
+	}
+	if err := nw.writeSet(nw.name+"6", "ipv6_addr", nw.v6Elements); err != nil {
+		return err
+	}
+	_, err := io.WriteString(nw.w, "}\n")
+	return err
+}
+
+// iptablesWriter writes one DROP rule per entry into the -chain chain,
+// using iptables for IPv4 entries and ip6tables for IPv6 entries.
+type iptablesWriter struct {
+	w     io.Writer
+	chain string
+}
+
+func (iw *iptablesWriter) begin() error { return nil }
+
+func (iw *iptablesWriter) write(r record) error {
+	cmd := "iptables"
+	if !r.prefix.Addr().Is4() {
+		cmd = "ip6tables"
+	}
+	_, err := fmt.Fprintf(iw.w, "%s -A %s -s %s -j DROP\n", cmd, iw.chain, formatPrefix(r.prefix))
+	return err
+}
+
+func (iw *iptablesWriter) end() error { return nil }
+
+// hostsDenyWriter writes a TCP wrappers hosts.deny list. IPv4 blocks use the
+// net/mask notation and IPv6 entries are bracketed as hosts_access expects.
+type hostsDenyWriter struct {
+	w io.Writer
+}
+
+func (hw *hostsDenyWriter) begin() error { return nil }
+
+func (hw *hostsDenyWriter) write(r record) error {
+	_, err := fmt.Fprintf(hw.w, "ALL: %s\n", hostsDenyPattern(r.prefix))
+	return err
+}
+
+func (hw *hostsDenyWriter) end() error { return nil }
+
+// hostsDenyPattern returns the hosts_access pattern matching p.
+func hostsDenyPattern(p netip.Prefix) string {
+	if p.Addr().Is4() {
+		if p.IsSingleIP() {
+			return p.Addr().String()
+		}
+		mask := net.CIDRMask(p.Bits(), 32)
+		return fmt.Sprintf("%s/%d.%d.%d.%d", p.Addr(), mask[0], mask[1], mask[2], mask[3])
+	}
+	if p.IsSingleIP() {
+		return "[" + p.Addr().String() + "]"
+	}
+	return fmt.Sprintf("[%s]/%d", p.Addr(), p.Bits())
+}